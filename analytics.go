@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/functions/crud"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// Days shown when no range is asked for, and the longest range allowed.
+const (
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 366
+)
+
+const analyticsDateFormat = "2006-01-02"
+
+// AnalyticsCounts are the counters of a video, a day or a whole channel.
+type AnalyticsCounts struct {
+	Views          int64   `json:"views"`
+	Likes          int64   `json:"likes"`
+	Comments       int64   `json:"comments"`
+	Plays          int64   `json:"plays"`
+	Completions    int64   `json:"completions"`
+	WatchSeconds   float64 `json:"watch_seconds"`
+	CompletionRate float64 `json:"completion_rate"`
+}
+
+func (c *AnalyticsCounts) Add(other AnalyticsCounts) {
+	c.Views += other.Views
+	c.Likes += other.Likes
+	c.Comments += other.Comments
+	c.Plays += other.Plays
+	c.Completions += other.Completions
+	c.WatchSeconds += other.WatchSeconds
+	c.rate()
+}
+
+func (c *AnalyticsCounts) rate() {
+	c.CompletionRate = 0
+	if c.Plays > 0 {
+		c.CompletionRate = float64(c.Completions) / float64(c.Plays)
+	}
+}
+
+// VideoAnalytics is a video's counters since it was uploaded, and over the
+// asked range.
+type VideoAnalytics struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+
+	AnalyticsCounts
+	Period AnalyticsCounts `json:"period"`
+
+	// Watch seconds since it was uploaded, by quality.
+	Qualities map[string]float64 `json:"qualities"`
+}
+
+// DailyAnalytics is what happened to every video of the user on a day.
+type DailyAnalytics struct {
+	Date string `json:"date"`
+	AnalyticsCounts
+}
+
+// The sums of the daily counters, grouped by group.
+const dailySums = "SUM(video_daily_stats.views) AS views, SUM(video_daily_stats.likes) AS likes, " +
+	"SUM(video_daily_stats.comments) AS comments, SUM(video_daily_stats.plays) AS plays, " +
+	"SUM(video_daily_stats.completions) AS completions, SUM(video_daily_stats.watch_seconds) AS watch_seconds"
+
+// Parses the range of days asked for, the last defaultAnalyticsDays days
+// otherwise. Both ends are included.
+func analyticsRange(r *http.Request) (time.Time, time.Time, error) {
+	to := statsDay(time.Now())
+	if value := r.URL.Query().Get("to"); len(value) > 0 {
+		parsed, err := time.ParseInLocation(analyticsDateFormat, value, time.Local)
+		if err != nil {
+			return to, to, NewAPIError(CODE_INVALID_REQUEST, "Invalid to, expected YYYY-MM-DD.")
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, 1-defaultAnalyticsDays)
+	if value := r.URL.Query().Get("from"); len(value) > 0 {
+		parsed, err := time.ParseInLocation(analyticsDateFormat, value, time.Local)
+		if err != nil {
+			return from, to, NewAPIError(CODE_INVALID_REQUEST, "Invalid from, expected YYYY-MM-DD.")
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return from, to, NewAPIError(CODE_INVALID_REQUEST, "from is after to.")
+	}
+	if from.AddDate(0, 0, maxAnalyticsDays).Before(to.AddDate(0, 0, 1)) {
+		return from, to, NewAPIError(CODE_INVALID_REQUEST, fmt.Sprintf("The range can't be longer than %d days.", maxAnalyticsDays))
+	}
+	return from, to, nil
+}
+
+// The counters of every video of the user, newest video first.
+func (s *Server) videoAnalytics(userID uint, from, to time.Time) ([]VideoAnalytics, error) {
+	// Counters are made along with the video, and were backfilled for the
+	// older ones on migration. Zeros only stand in for any still missing.
+	rows := make([]struct {
+		ID   uint
+		Name string
+		Key  string
+		AnalyticsCounts
+	}, 0)
+	err := s.DB.Model(&video.Video{}).
+		Select("videos.id, videos.name, videos.key, videos.views, "+
+			"COALESCE(video_stats.likes, 0) AS likes, COALESCE(video_stats.comments, 0) AS comments, "+
+			"COALESCE(video_stats.plays, 0) AS plays, COALESCE(video_stats.completions, 0) AS completions, "+
+			"COALESCE(video_stats.watch_seconds, 0) AS watch_seconds").
+		Joins("LEFT JOIN video_stats ON video_stats.video_id = videos.id").
+		Where("videos.user_id = ?", userID).
+		Order("videos.id DESC").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	periods := make([]struct {
+		VideoID uint
+		AnalyticsCounts
+	}, 0)
+	err = s.DB.Table("video_daily_stats").
+		Select("video_daily_stats.video_id, "+dailySums).
+		Joins("JOIN videos ON videos.id = video_daily_stats.video_id").
+		Where("videos.user_id = ? AND videos.deleted_at IS NULL AND video_daily_stats.day BETWEEN ? AND ?", userID, from, to).
+		Group("video_daily_stats.video_id").
+		Scan(&periods).Error
+	if err != nil {
+		return nil, err
+	}
+
+	qualities := make([]VideoQualityStats, 0)
+	err = s.DB.Model(&VideoQualityStats{}).
+		Select("video_quality_stats.*").
+		Joins("JOIN videos ON videos.id = video_quality_stats.video_id").
+		Where("videos.user_id = ? AND videos.deleted_at IS NULL", userID).
+		Scan(&qualities).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byVideo := make(map[uint]AnalyticsCounts, len(periods))
+	for _, period := range periods {
+		byVideo[period.VideoID] = period.AnalyticsCounts
+	}
+	qualitiesByVideo := make(map[uint]map[string]float64)
+	for _, quality := range qualities {
+		if _, ok := qualitiesByVideo[quality.VideoID]; !ok {
+			qualitiesByVideo[quality.VideoID] = make(map[string]float64)
+		}
+		qualitiesByVideo[quality.VideoID][quality.Quality] = quality.WatchSeconds
+	}
+	videos := make([]VideoAnalytics, 0, len(rows))
+	for _, row := range rows {
+		vid := VideoAnalytics{ID: row.ID, Name: row.Name, Key: row.Key, Qualities: qualitiesByVideo[row.ID]}
+		if vid.Qualities == nil {
+			vid.Qualities = map[string]float64{}
+		}
+		vid.Add(row.AnalyticsCounts)
+		vid.Period.Add(byVideo[row.ID])
+		videos = append(videos, vid)
+	}
+	return videos, nil
+}
+
+// Every day of the range, days without anything happening included.
+func (s *Server) dailyAnalytics(userID uint, from, to time.Time) ([]DailyAnalytics, error) {
+	rows := make([]struct {
+		Day time.Time
+		AnalyticsCounts
+	}, 0)
+	err := s.DB.Table("video_daily_stats").
+		Select("video_daily_stats.day, "+dailySums).
+		Joins("JOIN videos ON videos.id = video_daily_stats.video_id").
+		Where("videos.user_id = ? AND videos.deleted_at IS NULL AND video_daily_stats.day BETWEEN ? AND ?", userID, from, to).
+		Group("video_daily_stats.day").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byDay := make(map[string]AnalyticsCounts, len(rows))
+	for _, row := range rows {
+		byDay[row.Day.Format(analyticsDateFormat)] = row.AnalyticsCounts
+	}
+
+	days := make([]DailyAnalytics, 0)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(analyticsDateFormat)
+		daily := DailyAnalytics{Date: date}
+		daily.Add(byDay[date])
+		days = append(days, daily)
+	}
+	return days, nil
+}
+
+// Tells creators how their videos do. Everything comes from the counters
+// kept as things happen, ?from= and ?to= (YYYY-MM-DD, UTC days) pick the
+// days of the series.
+func (s *Server) HandleUserAnalytics(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	username := p.ByName("user")
+	if !requireOwner(w, r, username, "Only the owner can see their analytics.") {
+		return
+	}
+
+	from, to, err := analyticsRange(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	usr, err := crud.GetUserByName(s.DB, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		Fail(w, r, CODE_USER_NOT_FOUND, "User not found.")
+		return
+	}
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get user.")
+		return
+	}
+
+	videos, err := s.videoAnalytics(usr.ID, from, to)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get analytics.")
+		return
+	}
+	daily, err := s.dailyAnalytics(usr.ID, from, to)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get analytics.")
+		return
+	}
+
+	totals := AnalyticsCounts{}
+	period := AnalyticsCounts{}
+	for _, vid := range videos {
+		totals.Add(vid.AnalyticsCounts)
+		period.Add(vid.Period)
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"from":   from.Format(analyticsDateFormat),
+		"to":     to.Format(analyticsDateFormat),
+		"totals": totals,
+		"period": period,
+		"videos": videos,
+		"daily":  daily,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Reading the analytics of videos without counters mustn't write any.
+func TestVideoAnalyticsWithoutStats(t *testing.T) {
+	db, mock := newMockDBMatching(t, sqlmock.QueryMatcherFunc(func(expected, actual string) error {
+		if !strings.HasPrefix(strings.TrimSpace(actual), "SELECT") {
+			t.Errorf("analytics wrote: %s", actual)
+		}
+		return sqlmock.QueryMatcherRegexp.Match(expected, actual)
+	}))
+	s := &Server{Config: DefaultConfig(), DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT videos.id") + ".*" + regexp.QuoteMeta("LEFT JOIN video_stats")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "key", "views", "likes", "comments", "plays", "completions", "watch_seconds"}).
+			AddRow(8, "new", "def", 4, 0, 0, 0, 0, 0).
+			AddRow(7, "old", "abc", 10, 2, 1, 5, 4, 90.5))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT video_daily_stats.video_id")).WillReturnRows(
+		sqlmock.NewRows([]string{"video_id", "views"}).AddRow(7, 3),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT video_quality_stats.*")).WillReturnRows(
+		sqlmock.NewRows([]string{"video_id", "quality", "watch_seconds"}).AddRow(7, "720p", 90.5),
+	)
+
+	day := statsDay(time.Now())
+	videos, err := s.videoAnalytics(3, day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 || videos[0].ID != 8 || videos[0].Views != 4 || videos[0].Plays != 0 {
+		t.Fatalf("got %+v", videos)
+	}
+	if videos[1].CompletionRate != 0.8 || videos[1].Period.Views != 3 || videos[1].Qualities["720p"] != 90.5 {
+		t.Fatalf("got %+v", videos[1])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Older videos get the likes and comments they had, once.
+func TestBackfillVideoStats(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO video_stats (video_id, likes, comments, updated_at)") + ".*" +
+		regexp.QuoteMeta("FROM video_likes") + ".*" + regexp.QuoteMeta("FROM video_comments") + ".*" +
+		regexp.QuoteMeta("WHERE NOT EXISTS (SELECT 1 FROM video_stats WHERE video_stats.video_id = videos.id)")).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := backfillVideoStats(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
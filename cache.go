@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CachedPlaylist is a playlist whose urls have already been presigned.
+type CachedPlaylist struct {
+	Body []byte `json:"body"`
+
+	// Quoted hash of the body, sent as the ETag header.
+	ETag string `json:"etag"`
+
+	// When the playlist was generated.
+	ModTime time.Time `json:"mod_time"`
+
+	// When the playlist must stop being served.
+	Expires time.Time `json:"expires"`
+}
+
+func NewCachedPlaylist(body []byte, ttl time.Duration) *CachedPlaylist {
+	sum := sha256.Sum256(body)
+	now := time.Now()
+	return &CachedPlaylist{
+		Body:    body,
+		ETag:    fmt.Sprintf("%q", hex.EncodeToString(sum[:16])),
+		ModTime: now,
+		Expires: now.Add(ttl),
+	}
+}
+
+// PlaylistCache stores rewritten playlists until they expire.
+type PlaylistCache interface {
+	Get(ctx context.Context, key string) (*CachedPlaylist, bool)
+	Set(ctx context.Context, key string, playlist *CachedPlaylist)
+}
+
+// Creates the playlist cache selected by the configuration.
+func newPlaylistCache(cfg CacheConfig, client *redis.Client) (PlaylistCache, error) {
+	switch cfg.Backend {
+	case "memory":
+		return NewMemoryPlaylistCache(cfg.Size), nil
+	case "redis":
+		return &RedisPlaylistCache{Client: client, Prefix: "playlist:"}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+}
+
+/*----------------------
+|  Memory
+-----------------------*/
+
+// MemoryPlaylistCache keeps the playlists in process. When it is full the
+// playlist closest to expiring is dropped.
+type MemoryPlaylistCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*CachedPlaylist
+}
+
+func NewMemoryPlaylistCache(size int) *MemoryPlaylistCache {
+	return &MemoryPlaylistCache{
+		size:    size,
+		entries: make(map[string]*CachedPlaylist),
+	}
+}
+
+func (c *MemoryPlaylistCache) Get(ctx context.Context, key string) (*CachedPlaylist, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	playlist, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(playlist.Expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return playlist, true
+}
+
+func (c *MemoryPlaylistCache) Set(ctx context.Context, key string, playlist *CachedPlaylist) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[key] = playlist
+}
+
+// Drops every expired playlist, or the one expiring first if none are.
+// Must be called with the lock held.
+func (c *MemoryPlaylistCache) evict() {
+	now := time.Now()
+	oldestKey := ""
+	var oldest time.Time
+	for key, playlist := range c.entries {
+		if now.After(playlist.Expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if len(oldestKey) == 0 || playlist.Expires.Before(oldest) {
+			oldestKey = key
+			oldest = playlist.Expires
+		}
+	}
+	if len(c.entries) >= c.size && len(oldestKey) > 0 {
+		delete(c.entries, oldestKey)
+	}
+}
+
+/*----------------------
+|  Redis
+-----------------------*/
+
+// RedisPlaylistCache shares the playlists between every replica.
+type RedisPlaylistCache struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func (c *RedisPlaylistCache) Get(ctx context.Context, key string) (*CachedPlaylist, bool) {
+	content, err := c.Client.Get(ctx, c.Prefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Println("Failed to read cached playlist:", err)
+		}
+		return nil, false
+	}
+
+	playlist := &CachedPlaylist{}
+	if err := json.Unmarshal(content, playlist); err != nil {
+		log.Println("Failed to decode cached playlist:", err)
+		return nil, false
+	}
+	if time.Now().After(playlist.Expires) {
+		return nil, false
+	}
+	return playlist, true
+}
+
+func (c *RedisPlaylistCache) Set(ctx context.Context, key string, playlist *CachedPlaylist) {
+	ttl := time.Until(playlist.Expires)
+	if ttl <= 0 {
+		return
+	}
+	content, err := json.Marshal(playlist)
+	if err != nil {
+		log.Println("Failed to encode playlist:", err)
+		return
+	}
+	if err := c.Client.Set(ctx, c.Prefix+key, content, ttl).Err(); err != nil {
+		log.Println("Failed to cache playlist:", err)
+	}
+}
+
+/*----------------------
+|  Generation
+-----------------------*/
+
+// Makes sure concurrent requests for the same missing playlist only
+// generate it once.
+type playlistGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*playlistCall
+}
+
+type playlistCall struct {
+	done     chan struct{}
+	playlist *CachedPlaylist
+	err      error
+}
+
+func (g *playlistGroup) Do(key string, generate func() (*CachedPlaylist, error)) (*CachedPlaylist, error) {
+	g.mu.Lock()
+	if g.inflight == nil {
+		g.inflight = make(map[string]*playlistCall)
+	}
+	if call, ok := g.inflight[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.playlist, call.err
+	}
+	call := &playlistCall{done: make(chan struct{})}
+	g.inflight[key] = call
+	g.mu.Unlock()
+
+	call.playlist, call.err = generate()
+	close(call.done)
+
+	g.mu.Lock()
+	delete(g.inflight, key)
+	g.mu.Unlock()
+
+	return call.playlist, call.err
+}
+
+// Returns the presigned playlist of the video, only going to the bucket
+// when it isn't cached anymore. playlistPath is relative to the video's
+// directory, rootPlaylist being the one the players start with.
+func (s *Server) videoPlaylist(ctx context.Context, username, videoKey, playlistPath string) (*CachedPlaylist, error) {
+	key := fmt.Sprintf("%s/%s/%s", username, videoKey, playlistPath)
+	if playlist, ok := s.Playlists.Get(ctx, key); ok {
+		return playlist, nil
+	}
+
+	return s.playlistGroup.Do(key, func() (*CachedPlaylist, error) {
+		// The urls are presigned from now on, so the playlist has to be
+		// dropped Margin before they expire.
+		ttl := time.Duration(s.Config.Storage.PresignExpiry - s.Config.Cache.Margin)
+
+		variantUrl := func(variant string) string {
+			return fmt.Sprintf("%s/users/%s/videos/%s/playlists/%s", s.Config.Server.PublicURL, username, videoKey, variant)
+		}
+		buf, err := GenerateHSLFile(s.Storage, username, videoKey, playlistPath, variantUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		playlist := NewCachedPlaylist(buf.Bytes(), ttl)
+		s.Playlists.Set(ctx, key, playlist)
+		return playlist, nil
+	})
+}
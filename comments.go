@@ -0,0 +1,716 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/help-me-someone/scalable-p2-db/functions/crud"
+	"github.com/help-me-someone/scalable-p2-db/models/user"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Longest comment accepted, in characters.
+const maxCommentLength = 500
+
+// Comments returned per page, unless asked otherwise.
+const (
+	defaultCommentPage = 20
+	maxCommentPage     = 100
+)
+
+var (
+	errCommentNotFound = NewAPIError(CODE_COMMENT_NOT_FOUND, "Comment not found.")
+	errParentNotFound  = NewAPIError(CODE_COMMENT_NOT_FOUND, "Parent comment not found.")
+)
+
+// Replies sent along with each top level comment, the rest are fetched
+// with the parent parameter.
+const previewReplies = 3
+
+// Orders the comments can be listed in.
+const (
+	COMMENTS_NEWEST = "newest"
+	COMMENTS_OLDEST = "oldest"
+	COMMENTS_TOP    = "top"
+)
+
+// CommentView is a comment as the frontend renders it.
+type CommentView struct {
+	ID         uint          `json:"id"`
+	VideoID    uint          `json:"video_id"`
+	UserID     uint          `json:"user_id"`
+	Username   string        `json:"username"`
+	Comment    string        `json:"comment"`
+	Date       time.Time     `json:"date"`
+	ParentID   *uint         `json:"parent_id,omitempty"`
+	ReplyCount int           `json:"reply_count"`
+	Edited     bool          `json:"edited"`
+	EditedAt   *time.Time    `json:"edited_at,omitempty"`
+	Hidden     bool          `json:"hidden,omitempty"`
+	Replies    []CommentView `json:"replies,omitempty"`
+}
+
+// A comment along with its author's name.
+type commentRow struct {
+	Comment
+	Username string
+}
+
+func (c *commentRow) View() CommentView {
+	return CommentView{
+		ID:         c.ID,
+		VideoID:    c.VideoID,
+		UserID:     c.UserID,
+		Username:   c.Username,
+		Comment:    c.Comment.Comment,
+		Date:       c.Date,
+		ParentID:   c.ParentID,
+		ReplyCount: c.ReplyCount,
+		Edited:     c.EditedAt != nil,
+		EditedAt:   c.EditedAt,
+		Hidden:     c.Hidden,
+	}
+}
+
+// Where the previous page of comments ended.
+type commentCursor struct {
+	Order      string    `json:"o"`
+	ReplyCount int       `json:"r,omitempty"`
+	Date       time.Time `json:"d"`
+	ID         uint      `json:"i"`
+}
+
+// Trims the comment and makes sure it is something we want to show.
+func validateComment(comment string) (string, error) {
+	comment = strings.TrimSpace(comment)
+	if len(comment) == 0 {
+		return "", NewAPIError(CODE_INVALID_REQUEST, "Comment is empty.")
+	}
+	if !utf8.ValidString(comment) {
+		return "", NewAPIError(CODE_INVALID_REQUEST, "Comment is not valid UTF-8.")
+	}
+	if utf8.RuneCountInString(comment) > maxCommentLength {
+		return "", NewAPIError(CODE_INVALID_REQUEST, "Comment is longer than "+strconv.Itoa(maxCommentLength)+" characters.")
+	}
+	for _, c := range comment {
+		if unicode.IsControl(c) && c != '\n' && c != '\t' {
+			return "", NewAPIError(CODE_INVALID_REQUEST, "Comment contains control characters.")
+		}
+	}
+	return comment, nil
+}
+
+// Returns the user the request was made by.
+func (s *Server) requestUser(w http.ResponseWriter, r *http.Request) (*user.User, bool) {
+	username, ok := requireUsername(w, r)
+	if !ok {
+		return nil, false
+	}
+	usr, err := crud.GetUserByName(s.DB, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		Fail(w, r, CODE_UNAUTHENTICATED, "User not found.")
+		return nil, false
+	}
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get user.")
+		return nil, false
+	}
+	return usr, true
+}
+
+// Returns the video of the ":id" parameter.
+func (s *Server) videoParam(w http.ResponseWriter, r *http.Request, p httprouter.Params) (*video.Video, bool) {
+	id, err := strconv.ParseUint(p.ByName("id"), 10, 64)
+	if err != nil || id == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid video id.")
+		return nil, false
+	}
+	vid, err := crud.GetVideo(s.DB, uint(id))
+	if err != nil {
+		WriteError(w, r, videoLookupError(err))
+		return nil, false
+	}
+	return vid, true
+}
+
+// Returns the comment the reply goes under. Replying to a reply puts the
+// reply under the same top level comment.
+func (s *Server) replyParent(videoID, parentID uint) (*Comment, error) {
+	parent := &Comment{}
+	err := s.DB.First(parent, parentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || err == nil && parent.VideoID != videoID {
+		return nil, errParentNotFound
+	}
+	if err != nil {
+		return nil, Internal(err, "Failed to get parent comment.")
+	}
+	if parent.ParentID != nil {
+		return s.replyParent(videoID, *parent.ParentID)
+	}
+	return parent, nil
+}
+
+// Adds a comment to the video, written by the authenticated user.
+func (s *Server) HandleCreateComment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Comment  string `json:"comment"`
+		ParentID *uint  `json:"parent_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid comment.")
+		return
+	}
+	text, err := validateComment(payload.Comment)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	comment := &Comment{
+		VideoID: vid.ID,
+		UserID:  usr.ID,
+		Comment: text,
+		Date:    time.Now(),
+	}
+	if payload.ParentID != nil {
+		parent, err := s.replyParent(vid.ID, *payload.ParentID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		comment.ParentID = &parent.ID
+	}
+
+	if err := ensureVideoStats(s.DB, vid.ID); err != nil {
+		FailInternal(w, r, err, "Failed to create comment.")
+		return
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(comment).Error; err != nil {
+			return err
+		}
+		if err := incrementVideoStat(tx, vid.ID, "comments", 1); err != nil {
+			return err
+		}
+		err := recordDailyStats(tx, &VideoDailyStats{VideoID: vid.ID, Day: comment.Date, Comments: 1})
+		if err != nil {
+			return err
+		}
+
+		// Everyone involved is notified by a task, saved along with the
+		// comment so it can't get lost.
+		task, err := NewNotificationFanoutTask(fmt.Sprintf("comment:%d", comment.ID), vid.ID, usr.ID, video.Comment)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(NewOutboxTask(task, 0)).Error; err != nil {
+			return err
+		}
+
+		if comment.ParentID == nil {
+			return nil
+		}
+		// The parent was deleted since it was looked up, taking its
+		// replies with it.
+		result := tx.Model(&Comment{}).
+			Where("id = ?", *comment.ParentID).
+			Update("reply_count", gorm.Expr("reply_count + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errParentNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		WriteError(w, r, orInternal(err, "Failed to create comment."))
+		return
+	}
+	s.Outbox.Notify()
+
+	row := commentRow{Comment: *comment, Username: usr.Username}
+	WriteJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"message": "Comment created.",
+		"comment": row.View(),
+	})
+}
+
+// Selects comments along with their author's name.
+func (s *Server) commentQuery() *gorm.DB {
+	return s.DB.
+		Model(&Comment{}).
+		Select("video_comments.*, users.username").
+		Joins("JOIN users ON users.id = video_comments.user_id")
+}
+
+// Applies the order, and where the previous page ended.
+func pageComments(query *gorm.DB, order string, cursor *commentCursor) *gorm.DB {
+	switch order {
+	case COMMENTS_OLDEST:
+		if cursor != nil {
+			query = query.Where(
+				"video_comments.date > ? OR (video_comments.date = ? AND video_comments.id > ?)",
+				cursor.Date, cursor.Date, cursor.ID,
+			)
+		}
+		return query.Order("video_comments.date ASC, video_comments.id ASC")
+	case COMMENTS_TOP:
+		if cursor != nil {
+			query = query.Where(
+				"video_comments.reply_count < ? OR (video_comments.reply_count = ? AND (video_comments.date < ? OR (video_comments.date = ? AND video_comments.id < ?)))",
+				cursor.ReplyCount, cursor.ReplyCount, cursor.Date, cursor.Date, cursor.ID,
+			)
+		}
+		return query.Order("video_comments.reply_count DESC, video_comments.date DESC, video_comments.id DESC")
+	default:
+		if cursor != nil {
+			query = query.Where(
+				"video_comments.date < ? OR (video_comments.date = ? AND video_comments.id < ?)",
+				cursor.Date, cursor.Date, cursor.ID,
+			)
+		}
+		return query.Order("video_comments.date DESC, video_comments.id DESC")
+	}
+}
+
+// Hidden comments are only shown to their author and to moderators.
+func commentVisibility(viewerID uint, moderator bool) func(*gorm.DB) *gorm.DB {
+	return func(query *gorm.DB) *gorm.DB {
+		if moderator {
+			return query
+		}
+		return query.Where("video_comments.hidden = ? OR video_comments.user_id = ?", false, viewerID)
+	}
+}
+
+// Returns who is looking at the comments of the video. Anonymous viewers
+// are let through, they just don't see the hidden comments.
+func (s *Server) commentViewer(r *http.Request, vid *video.Video) (uint, bool) {
+	username := r.Header.Get("X-Username")
+	if len(username) == 0 {
+		return 0, false
+	}
+	usr, err := crud.GetUserByName(s.DB, username)
+	if err != nil {
+		return 0, false
+	}
+	return usr.ID, usr.ID == vid.UserID || s.Config.IsAdmin(username)
+}
+
+// Lists the comments of a video a page at a time. Top level comments come
+// with their first replies, the replies of a single comment are listed by
+// passing its id as "parent".
+func (s *Server) HandleListComments(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	// Replies read best in the order they were made.
+	order := query.Get("order")
+	if len(order) == 0 {
+		order = COMMENTS_NEWEST
+		if len(query.Get("parent")) > 0 {
+			order = COMMENTS_OLDEST
+		}
+	}
+	if order != COMMENTS_NEWEST && order != COMMENTS_OLDEST && order != COMMENTS_TOP {
+		Fail(w, r, CODE_INVALID_REQUEST, "Order must be newest, oldest or top.")
+		return
+	}
+
+	limit, err := pageLimit(r, defaultCommentPage, maxCommentPage)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	var cursor *commentCursor
+	if value := query.Get("cursor"); len(value) > 0 {
+		cursor = &commentCursor{}
+		if err := decodeCursor(value, cursor); err != nil || cursor.Order != order {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid cursor.")
+			return
+		}
+	}
+
+	visible := commentVisibility(s.commentViewer(r, vid))
+	comments := s.commentQuery().Scopes(visible).Where("video_comments.video_id = ?", vid.ID)
+	if value := query.Get("parent"); len(value) > 0 {
+		parentID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid parent id.")
+			return
+		}
+		// The replies of a hidden comment are as hidden as it is.
+		parent := &Comment{}
+		err = s.DB.Scopes(visible).Where("video_comments.video_id = ?", vid.ID).First(parent, parentID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			WriteError(w, r, errCommentNotFound)
+			return
+		}
+		if err != nil {
+			FailInternal(w, r, err, "Failed to get parent comment.")
+			return
+		}
+		comments = comments.Where("video_comments.parent_id = ?", parent.ID)
+	} else {
+		comments = comments.Where("video_comments.parent_id IS NULL")
+	}
+
+	// One more than asked, to know whether there is a next page.
+	rows := make([]commentRow, 0)
+	err = pageComments(comments, order, cursor).Limit(limit + 1).Scan(&rows).Error
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get comments.")
+		return
+	}
+
+	next := ""
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[limit-1]
+		next = encodeCursor(commentCursor{
+			Order:      order,
+			ReplyCount: last.ReplyCount,
+			Date:       last.Date,
+			ID:         last.ID,
+		})
+	}
+
+	views := make([]CommentView, 0, len(rows))
+	for i := range rows {
+		view := rows[i].View()
+		if rows[i].ParentID == nil && rows[i].ReplyCount > 0 {
+			replies, err := s.commentReplies(rows[i].ID, previewReplies, visible)
+			if err != nil {
+				FailInternal(w, r, err, "Failed to get replies.")
+				return
+			}
+			view.Replies = replies
+		}
+		views = append(views, view)
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"comments":    views,
+		"next_cursor": next,
+	})
+}
+
+// Returns the first replies of a comment.
+func (s *Server) commentReplies(parentID uint, limit int, visible func(*gorm.DB) *gorm.DB) ([]CommentView, error) {
+	rows := make([]commentRow, 0)
+	replies := s.commentQuery().Scopes(visible).Where("video_comments.parent_id = ?", parentID)
+	err := pageComments(replies, COMMENTS_OLDEST, nil).
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	views := make([]CommentView, 0, len(rows))
+	for i := range rows {
+		views = append(views, rows[i].View())
+	}
+	return views, nil
+}
+
+/*----------------------
+|  Moderation
+-----------------------*/
+
+// Returns the comment of the ":comment" parameter, which has to be on the
+// video.
+func (s *Server) commentParam(w http.ResponseWriter, r *http.Request, p httprouter.Params, vid *video.Video) (*Comment, bool) {
+	id, err := strconv.ParseUint(p.ByName("comment"), 10, 64)
+	if err != nil || id == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid comment id.")
+		return nil, false
+	}
+	comment := &Comment{}
+	err = s.DB.First(comment, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || err == nil && comment.VideoID != vid.ID {
+		WriteError(w, r, errCommentNotFound)
+		return nil, false
+	}
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get comment.")
+		return nil, false
+	}
+	return comment, true
+}
+
+// Everything the moderation endpoints need: who is asking, the video and
+// the comment.
+type commentAction struct {
+	User    *user.User
+	Video   *video.Video
+	Comment *Comment
+}
+
+func (a *commentAction) IsAuthor() bool {
+	return a.Comment.UserID == a.User.ID
+}
+
+func (a *commentAction) IsOwner() bool {
+	return a.Video.UserID == a.User.ID
+}
+
+func (s *Server) commentActionParams(w http.ResponseWriter, r *http.Request, p httprouter.Params) (*commentAction, bool) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return nil, false
+	}
+	comment, ok := s.commentParam(w, r, p, vid)
+	if !ok {
+		return nil, false
+	}
+	return &commentAction{User: usr, Video: vid, Comment: comment}, true
+}
+
+// Changes the comment, only its author can. What it said before is kept
+// in its history.
+func (s *Server) HandleEditComment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	action, ok := s.commentActionParams(w, r, p)
+	if !ok {
+		return
+	}
+	if !action.IsAuthor() {
+		Fail(w, r, CODE_FORBIDDEN, "Only the author can edit the comment.")
+		return
+	}
+
+	payload := struct {
+		Comment string `json:"comment"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid comment.")
+		return
+	}
+	text, err := validateComment(payload.Comment)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	comment := action.Comment
+	if text != comment.Comment {
+		now := time.Now()
+		err = s.DB.Transaction(func(tx *gorm.DB) error {
+			edit := &CommentEdit{
+				CommentID: comment.ID,
+				Comment:   comment.Comment,
+				Date:      now,
+			}
+			if err := tx.Create(edit).Error; err != nil {
+				return err
+			}
+			return tx.Model(comment).Updates(map[string]interface{}{
+				"comment":   text,
+				"edited_at": now,
+			}).Error
+		})
+		if err != nil {
+			FailInternal(w, r, err, "Failed to edit comment.")
+			return
+		}
+		comment.Comment = text
+		comment.EditedAt = &now
+	}
+
+	row := commentRow{Comment: *comment, Username: action.User.Username}
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Comment edited.",
+		"comment": row.View(),
+	})
+}
+
+// Deletes the comment. Authors can delete their comments, owners any
+// comment on their video and admins any comment at all. Deleting a top
+// level comment deletes its replies along with it.
+func (s *Server) HandleDeleteComment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	action, ok := s.commentActionParams(w, r, p)
+	if !ok {
+		return
+	}
+	if !action.IsAuthor() && !action.IsOwner() && !s.Config.IsAdmin(action.User.Username) {
+		Fail(w, r, CODE_FORBIDDEN, "You can't delete this comment.")
+		return
+	}
+
+	comment := action.Comment
+	if err := ensureVideoStats(s.DB, comment.VideoID); err != nil {
+		FailInternal(w, r, err, "Failed to delete comment.")
+		return
+	}
+
+	deleted := 0
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(comment).Update("deleted_by", action.User.ID).Error; err != nil {
+			return err
+		}
+		// Whoever deleted it first already took it off the counters.
+		result := tx.Delete(comment)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errCommentNotFound
+		}
+
+		removed := []Comment{*comment}
+		if comment.ParentID == nil {
+			replies, err := deleteReplies(tx, comment.ID, action.User.ID)
+			if err != nil {
+				return err
+			}
+			removed = append(removed, replies...)
+		} else {
+			err := tx.Model(&Comment{}).
+				Where("id = ? AND reply_count > 0", *comment.ParentID).
+				Update("reply_count", gorm.Expr("reply_count - 1")).Error
+			if err != nil {
+				return err
+			}
+		}
+		deleted = len(removed)
+
+		// Taken off the day they were made, so the days only count the
+		// comments which are still there.
+		if err := incrementVideoStat(tx, comment.VideoID, "comments", -int64(len(removed))); err != nil {
+			return err
+		}
+		days := map[time.Time]int64{}
+		for _, c := range removed {
+			days[statsDay(c.Date)]--
+		}
+		for day, count := range days {
+			err := recordDailyStats(tx, &VideoDailyStats{VideoID: comment.VideoID, Day: day, Comments: count})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		WriteError(w, r, orInternal(err, "Failed to delete comment."))
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Comment deleted.",
+		"deleted": deleted,
+	})
+}
+
+// Deletes the replies of a top level comment which is being deleted, and
+// returns them. They are locked first, so a reply made at the same time
+// either makes it into the list or fails to find its parent.
+func deleteReplies(tx *gorm.DB, parentID, deletedBy uint) ([]Comment, error) {
+	replies := make([]Comment, 0)
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("parent_id = ?", parentID).
+		Find(&replies).Error
+	if err != nil || len(replies) == 0 {
+		return replies, err
+	}
+
+	ids := make([]uint, 0, len(replies))
+	for _, reply := range replies {
+		ids = append(ids, reply.ID)
+	}
+	err = tx.Model(&Comment{}).Where("id IN ?", ids).Update("deleted_by", deletedBy).Error
+	if err != nil {
+		return nil, err
+	}
+	return replies, tx.Where("id IN ?", ids).Delete(&Comment{}).Error
+}
+
+// Hides or shows the comment again, for the video's owner and admins.
+func (s *Server) setCommentHidden(w http.ResponseWriter, r *http.Request, p httprouter.Params, hidden bool) {
+	action, ok := s.commentActionParams(w, r, p)
+	if !ok {
+		return
+	}
+	if !action.IsOwner() && !s.Config.IsAdmin(action.User.Username) {
+		Fail(w, r, CODE_FORBIDDEN, "Only the video's owner can hide comments.")
+		return
+	}
+
+	if err := s.DB.Model(action.Comment).Update("hidden", hidden).Error; err != nil {
+		FailInternal(w, r, err, "Failed to update comment.")
+		return
+	}
+
+	message := "Comment shown."
+	if hidden {
+		message = "Comment hidden."
+	}
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": message,
+		"hidden":  hidden,
+	})
+}
+
+func (s *Server) HandleHideComment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setCommentHidden(w, r, p, true)
+}
+
+func (s *Server) HandleShowComment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setCommentHidden(w, r, p, false)
+}
+
+// Lists what the comment said before each edit, newest first. Only the
+// people who could moderate the comment can see it.
+func (s *Server) HandleCommentHistory(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	action, ok := s.commentActionParams(w, r, p)
+	if !ok {
+		return
+	}
+	if !action.IsAuthor() && !action.IsOwner() && !s.Config.IsAdmin(action.User.Username) {
+		Fail(w, r, CODE_FORBIDDEN, "You can't see this comment's history.")
+		return
+	}
+
+	edits := make([]CommentEdit, 0)
+	err := s.DB.
+		Where(&CommentEdit{CommentID: action.Comment.ID}).
+		Order("date DESC, id DESC").
+		Find(&edits).Error
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get comment history.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"edits": edits,
+	})
+}
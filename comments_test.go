@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Expects the lookups of bob deleting comment 20 of video 7.
+func expectCommentAction(mock sqlmock.Sqlmock, parentID driver.Value, date time.Time) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username"}).AddRow(3, "bob"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `videos`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "key"}).AddRow(7, 9, "abc"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_comments`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "video_id", "user_id", "comment", "date", "parent_id"}).
+			AddRow(20, 7, 3, "first!", date, parentID),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `video_id` FROM `video_stats`")).WillReturnRows(
+		sqlmock.NewRows([]string{"video_id"}).AddRow(7),
+	)
+}
+
+func deleteCommentRequest(s *Server) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/videos/7/comments/20", nil)
+	r.Header.Set("X-Username", "bob")
+	w := httptest.NewRecorder()
+	s.HandleDeleteComment(w, r, httprouter.Params{
+		{Key: "id", Value: "7"},
+		{Key: "comment", Value: "20"},
+	})
+	return w
+}
+
+func TestDeleteCommentWithReplies(t *testing.T) {
+	db, mock := newMockDB(t)
+	s := &Server{Config: DefaultConfig(), DB: db}
+
+	today := time.Date(2023, 11, 2, 12, 0, 0, 0, time.UTC)
+	yesterday := today.Add(-24 * time.Hour)
+	expectCommentAction(mock, nil, yesterday)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_by`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_at`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_comments` WHERE parent_id = ?") + ".*FOR UPDATE").
+		WithArgs(20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "video_id", "user_id", "date", "parent_id"}).
+			AddRow(21, 7, 4, yesterday, 20).
+			AddRow(22, 7, 5, today, 20))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_by`=?")).
+		WithArgs(3, 21, 22).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_at`=?")).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_stats` SET `comments`=comments + ?")).
+		WithArgs(-3, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// One row per day the comments were made on.
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := deleteCommentRequest(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Deleted int `json:"deleted"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Deleted != 3 {
+		t.Fatalf("deleted %d comments", body.Deleted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteReply(t *testing.T) {
+	db, mock := newMockDB(t)
+	s := &Server{Config: DefaultConfig(), DB: db}
+
+	expectCommentAction(mock, 19, time.Now())
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_by`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_at`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `reply_count`=reply_count - 1")).
+		WithArgs(19).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_stats` SET `comments`=comments + ?")).
+		WithArgs(-1, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := deleteCommentRequest(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Two deletes of the same comment race, the second one mustn't take it off
+// the counters again.
+func TestDeleteCommentTwice(t *testing.T) {
+	db, mock := newMockDB(t)
+	s := &Server{Config: DefaultConfig(), DB: db}
+
+	expectCommentAction(mock, 19, time.Now())
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_by`=?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_comments` SET `deleted_at`=?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	w := deleteCommentRequest(s)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("delete returned %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The replies of a hidden comment can't be listed by those who can't see it.
+func TestListRepliesOfHiddenComment(t *testing.T) {
+	db, mock := newMockDB(t)
+	s := &Server{Config: DefaultConfig(), DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `videos`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "key"}).AddRow(7, 9, "abc"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_comments` WHERE video_comments.video_id = ? AND `video_comments`.`id` = ? AND (video_comments.hidden = ? OR video_comments.user_id = ?)")).
+		WithArgs(7, 20, false, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	r := httptest.NewRequest(http.MethodGet, "/videos/7/comments?parent=20", nil)
+	w := httptest.NewRecorder()
+	s.HandleListComments(w, r, httprouter.Params{{Key: "id", Value: "7"}})
+
+	var body struct {
+		Error struct {
+			Code ErrorCode `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusNotFound || body.Error.Code != CODE_COMMENT_NOT_FOUND {
+		t.Fatalf("returned %d %q", w.Code, body.Error.Code)
+	}
+	// The replies weren't looked at.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
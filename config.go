@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything the backend needs to start. It is built from the
+// defaults below, then an optional YAML/JSON file, then the environment.
+type Config struct {
+	Server   ServerConfig   `json:"server" yaml:"server"`
+	Database DatabaseConfig `json:"database" yaml:"database"`
+	Redis    RedisConfig    `json:"redis" yaml:"redis"`
+	Storage  StorageConfig  `json:"storage" yaml:"storage"`
+	Cache    CacheConfig    `json:"cache" yaml:"cache"`
+	Upload   UploadConfig   `json:"upload" yaml:"upload"`
+	Outbox   OutboxConfig   `json:"outbox" yaml:"outbox"`
+
+	Notifications NotificationsConfig `json:"notifications" yaml:"notifications"`
+	Views         ViewsConfig         `json:"views" yaml:"views"`
+	Ranking       RankingConfig       `json:"ranking" yaml:"ranking"`
+}
+
+// Duration is a time.Duration which is written as "15m" in config files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+type ServerConfig struct {
+	// Port the http server listens on.
+	Port int `json:"port" yaml:"port"`
+
+	// Origin allowed to make CORS requests.
+	AllowedOrigin string `json:"allowed_origin" yaml:"allowed_origin"`
+
+	// Set to "DEBUG" to enable verbose logging.
+	Mode string `json:"mode" yaml:"mode"`
+
+	// Url the players reach the API at, used to link variant playlists.
+	// Links are relative to the host when empty.
+	PublicURL string `json:"public_url" yaml:"public_url"`
+
+	// Usernames allowed to moderate anything.
+	Admins []string `json:"admins" yaml:"admins"`
+
+	// Addresses or CIDR ranges of the proxies in front of the server. Only
+	// their X-Forwarded-For headers are believed.
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+}
+
+type DatabaseConfig struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+
+	// Address of the MySQL server, e.g. "localhost:3306".
+	Host string `json:"host" yaml:"host"`
+
+	// Name of the database.
+	Name string `json:"name" yaml:"name"`
+}
+
+type RedisConfig struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+type StorageConfig struct {
+	// "s3" or "local".
+	Backend string `json:"backend" yaml:"backend"`
+
+	// S3 settings. The endpoint defaults to DigitalOcean Spaces in Region.
+	Region   string `json:"region" yaml:"region"`
+	Bucket   string `json:"bucket" yaml:"bucket"`
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+
+	// Local settings. URL is where the backend serves the stored files
+	// and Secret is used to sign the urls it hands out.
+	Dir    string `json:"dir" yaml:"dir"`
+	URL    string `json:"url" yaml:"url"`
+	Secret string `json:"secret" yaml:"secret"`
+
+	// How long presigned urls stay valid.
+	PresignExpiry Duration `json:"presign_expiry" yaml:"presign_expiry"`
+}
+
+type CacheConfig struct {
+	// Where rewritten playlists are cached, "memory" or "redis".
+	Backend string `json:"backend" yaml:"backend"`
+
+	// Maximum number of playlists kept by the memory cache.
+	Size int `json:"size" yaml:"size"`
+
+	// Playlists are evicted this long before their presigned urls
+	// expire, so a player always has at least Margin to use them.
+	Margin Duration `json:"margin" yaml:"margin"`
+}
+
+type UploadConfig struct {
+	// How long an upload url can be used before the video is saved.
+	SessionTTL Duration `json:"session_ttl" yaml:"session_ttl"`
+
+	// Largest video accepted, in bytes.
+	MaxSize int64 `json:"max_size" yaml:"max_size"`
+
+	// Content types accepted for the uploaded video. The type is sniffed
+	// from the first bytes of the upload, not taken from the client.
+	ContentTypes []string `json:"content_types" yaml:"content_types"`
+}
+
+type OutboxConfig struct {
+	// How often pending tasks are looked for. New tasks are usually queued
+	// right away, this only matters for retries and other replicas' tasks.
+	Interval Duration `json:"interval" yaml:"interval"`
+
+	// Tasks queued per transaction.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+
+	// A task is marked failed after this many attempts.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+}
+
+type NotificationsConfig struct {
+	// Fan-out tasks processed at the same time by this replica.
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+
+	// Notifications created per transaction.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+}
+
+type ViewsConfig struct {
+	// A viewer is counted once per video within this window.
+	Window Duration `json:"window" yaml:"window"`
+
+	// How often the views counted in redis are added to the videos.
+	FlushInterval Duration `json:"flush_interval" yaml:"flush_interval"`
+
+	// Videos updated per transaction.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+}
+
+type RankingConfig struct {
+	// How often the rankings are recomputed.
+	Interval Duration `json:"interval" yaml:"interval"`
+
+	// Videos kept per ranking.
+	Size int `json:"size" yaml:"size"`
+
+	// How long a snapshot of a ranking can be paged through. Clients
+	// scrolling for longer have to start again.
+	SnapshotTTL Duration `json:"snapshot_ttl" yaml:"snapshot_ttl"`
+
+	// What a view, a like and a comment are worth.
+	ViewWeight    float64 `json:"view_weight" yaml:"view_weight"`
+	LikeWeight    float64 `json:"like_weight" yaml:"like_weight"`
+	CommentWeight float64 `json:"comment_weight" yaml:"comment_weight"`
+
+	// What a play, a completed play and a second watched are worth, as
+	// reported by the players.
+	PlayWeight        float64 `json:"play_weight" yaml:"play_weight"`
+	CompletionWeight  float64 `json:"completion_weight" yaml:"completion_weight"`
+	WatchSecondWeight float64 `json:"watch_second_weight" yaml:"watch_second_weight"`
+
+	// How fast hot videos cool down with age, higher is faster.
+	Gravity float64 `json:"gravity" yaml:"gravity"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: 7000,
+		},
+		Database: DatabaseConfig{
+			Name: "toktik-db",
+		},
+		Redis: RedisConfig{
+			Port: 6379,
+		},
+		Storage: StorageConfig{
+			Backend: "s3",
+			Region:  "sgp1",
+			Bucket:  "toktik-videos",
+			Dir:     "data",
+
+			PresignExpiry: Duration(defaultPresignExpiry),
+		},
+		Cache: CacheConfig{
+			Backend: "memory",
+			Size:    1024,
+			Margin:  Duration(5 * time.Minute),
+		},
+		Upload: UploadConfig{
+			SessionTTL: Duration(24 * time.Hour),
+			MaxSize:    1 << 30,
+			ContentTypes: []string{
+				"video/mp4",
+				"video/quicktime",
+				"video/webm",
+				"video/x-matroska",
+			},
+		},
+		Outbox: OutboxConfig{
+			Interval:    Duration(5 * time.Second),
+			BatchSize:   100,
+			MaxAttempts: 10,
+		},
+		Notifications: NotificationsConfig{
+			Concurrency: 5,
+			BatchSize:   500,
+		},
+		Views: ViewsConfig{
+			Window:        Duration(30 * time.Minute),
+			FlushInterval: Duration(10 * time.Second),
+			BatchSize:     500,
+		},
+		Ranking: RankingConfig{
+			Interval:      Duration(time.Minute),
+			Size:          1000,
+			SnapshotTTL:   Duration(30 * time.Minute),
+			ViewWeight:    1,
+			LikeWeight:    5,
+			CommentWeight: 10,
+
+			PlayWeight:        1,
+			CompletionWeight:  3,
+			WatchSecondWeight: 0.05,
+
+			Gravity: 1.5,
+		},
+	}
+}
+
+// LoadConfig builds the configuration. path may be empty, in which case only
+// the defaults and the environment are used.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if len(path) > 0 {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// Fill in the values which depend on others.
+	cfg.Server.PublicURL = strings.TrimSuffix(cfg.Server.PublicURL, "/")
+	if len(cfg.Storage.URL) == 0 {
+		cfg.Storage.URL = fmt.Sprintf("http://localhost:%d/storage", cfg.Server.Port)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(content, c)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, c)
+	default:
+		return fmt.Errorf("unsupported config file %q, expected .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return nil
+}
+
+// The environment always wins over the config file.
+func (c *Config) loadEnv() error {
+	strs := map[string]*string{
+		"ALLOWED_ORIGIN":   &c.Server.AllowedOrigin,
+		"MODE":             &c.Server.Mode,
+		"PUBLIC_URL":       &c.Server.PublicURL,
+		"DB_USERNAME":      &c.Database.Username,
+		"DB_PASSWORD":      &c.Database.Password,
+		"DB_IP":            &c.Database.Host,
+		"DB_NAME":          &c.Database.Name,
+		"REDIS_IP":         &c.Redis.Host,
+		"STORAGE_BACKEND":  &c.Storage.Backend,
+		"STORAGE_REGION":   &c.Storage.Region,
+		"STORAGE_BUCKET":   &c.Storage.Bucket,
+		"STORAGE_ENDPOINT": &c.Storage.Endpoint,
+		"STORAGE_DIR":      &c.Storage.Dir,
+		"STORAGE_URL":      &c.Storage.URL,
+		"STORAGE_SECRET":   &c.Storage.Secret,
+		"CACHE_BACKEND":    &c.Cache.Backend,
+	}
+	for name, field := range strs {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+
+	ints := map[string]*int{
+		"PORT":       &c.Server.Port,
+		"REDIS_PORT": &c.Redis.Port,
+		"CACHE_SIZE": &c.Cache.Size,
+
+		"OUTBOX_BATCH_SIZE":   &c.Outbox.BatchSize,
+		"OUTBOX_MAX_ATTEMPTS": &c.Outbox.MaxAttempts,
+
+		"NOTIFICATIONS_CONCURRENCY": &c.Notifications.Concurrency,
+		"NOTIFICATIONS_BATCH_SIZE":  &c.Notifications.BatchSize,
+		"VIEWS_BATCH_SIZE":          &c.Views.BatchSize,
+		"RANKING_SIZE":              &c.Ranking.Size,
+	}
+	for name, field := range ints {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, value)
+		}
+		*field = parsed
+	}
+
+	durations := map[string]*Duration{
+		"PRESIGN_EXPIRY":  &c.Storage.PresignExpiry,
+		"CACHE_MARGIN":    &c.Cache.Margin,
+		"UPLOAD_TTL":      &c.Upload.SessionTTL,
+		"OUTBOX_INTERVAL": &c.Outbox.Interval,
+
+		"VIEWS_WINDOW":         &c.Views.Window,
+		"VIEWS_FLUSH_INTERVAL": &c.Views.FlushInterval,
+		"RANKING_INTERVAL":     &c.Ranking.Interval,
+		"RANKING_SNAPSHOT_TTL": &c.Ranking.SnapshotTTL,
+	}
+	for name, field := range durations {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := field.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("%s must be a duration, got %q", name, value)
+		}
+	}
+
+	if value, ok := os.LookupEnv("UPLOAD_MAX_SIZE"); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("UPLOAD_MAX_SIZE must be a number, got %q", value)
+		}
+		c.Upload.MaxSize = parsed
+	}
+	if value, ok := os.LookupEnv("UPLOAD_CONTENT_TYPES"); ok {
+		c.Upload.ContentTypes = strings.Split(value, ",")
+	}
+	if value, ok := os.LookupEnv("ADMINS"); ok {
+		c.Server.Admins = strings.Split(value, ",")
+	}
+	if value, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		c.Server.TrustedProxies = strings.Split(value, ",")
+	}
+
+	return nil
+}
+
+// Validate makes sure we fail at startup rather than on the first request.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		problems = append(problems, "server port must be between 1 and 65535")
+	}
+	if _, err := c.TrustedProxies(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(c.Database.Username) == 0 {
+		problems = append(problems, "database username is missing (DB_USERNAME)")
+	}
+	if len(c.Database.Password) == 0 {
+		problems = append(problems, "database password is missing (DB_PASSWORD)")
+	}
+	if len(c.Database.Host) == 0 {
+		problems = append(problems, "database host is missing (DB_IP)")
+	}
+	if len(c.Database.Name) == 0 {
+		problems = append(problems, "database name is missing (DB_NAME)")
+	}
+
+	if len(c.Redis.Host) == 0 {
+		problems = append(problems, "redis host is missing (REDIS_IP)")
+	}
+	if c.Redis.Port <= 0 || c.Redis.Port > 65535 {
+		problems = append(problems, "redis port must be between 1 and 65535")
+	}
+
+	switch c.Storage.Backend {
+	case "s3":
+		if len(c.Storage.Region) == 0 {
+			problems = append(problems, "storage region is missing (STORAGE_REGION)")
+		}
+		if len(c.Storage.Bucket) == 0 {
+			problems = append(problems, "storage bucket is missing (STORAGE_BUCKET)")
+		}
+	case "local":
+		if len(c.Storage.Dir) == 0 {
+			problems = append(problems, "storage directory is missing (STORAGE_DIR)")
+		}
+		// Every replica has to sign the urls the same way, and keep doing so
+		// after a restart.
+		if len(c.Storage.Secret) == 0 {
+			problems = append(problems, "storage secret is missing (STORAGE_SECRET)")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown storage backend %q", c.Storage.Backend))
+	}
+
+	// S3 refuses to presign for longer than a week.
+	if c.Storage.PresignExpiry <= 0 || time.Duration(c.Storage.PresignExpiry) > 7*24*time.Hour {
+		problems = append(problems, "storage presign expiry must be between 0 and 7 days")
+	}
+
+	switch c.Cache.Backend {
+	case "memory":
+		if c.Cache.Size <= 0 {
+			problems = append(problems, "cache size must be positive")
+		}
+	case "redis":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown cache backend %q", c.Cache.Backend))
+	}
+	if c.Cache.Margin < 0 || c.Cache.Margin >= c.Storage.PresignExpiry {
+		problems = append(problems, "cache margin must be shorter than the presign expiry")
+	}
+
+	if c.Upload.SessionTTL <= 0 {
+		problems = append(problems, "upload session ttl must be positive")
+	}
+	if c.Upload.MaxSize <= 0 {
+		problems = append(problems, "upload max size must be positive")
+	}
+	if len(c.Upload.ContentTypes) == 0 {
+		problems = append(problems, "at least one upload content type must be allowed")
+	}
+
+	if c.Outbox.Interval <= 0 {
+		problems = append(problems, "outbox interval must be positive")
+	}
+	if c.Outbox.BatchSize <= 0 {
+		problems = append(problems, "outbox batch size must be positive")
+	}
+	if c.Outbox.MaxAttempts <= 0 {
+		problems = append(problems, "outbox max attempts must be positive")
+	}
+
+	if c.Notifications.Concurrency <= 0 {
+		problems = append(problems, "notifications concurrency must be positive")
+	}
+	if c.Notifications.BatchSize <= 0 {
+		problems = append(problems, "notifications batch size must be positive")
+	}
+
+	if c.Views.Window <= 0 {
+		problems = append(problems, "views window must be positive")
+	}
+	if c.Views.FlushInterval <= 0 {
+		problems = append(problems, "views flush interval must be positive")
+	}
+	if c.Views.BatchSize <= 0 {
+		problems = append(problems, "views batch size must be positive")
+	}
+
+	if c.Ranking.Interval <= 0 {
+		problems = append(problems, "ranking interval must be positive")
+	}
+	if c.Ranking.Size <= 0 {
+		problems = append(problems, "ranking size must be positive")
+	}
+	if c.Ranking.SnapshotTTL <= c.Ranking.Interval {
+		problems = append(problems, "ranking snapshot ttl must be longer than the interval")
+	}
+	if c.Ranking.ViewWeight < 0 || c.Ranking.LikeWeight < 0 || c.Ranking.CommentWeight < 0 ||
+		c.Ranking.PlayWeight < 0 || c.Ranking.CompletionWeight < 0 || c.Ranking.WatchSecondWeight < 0 {
+		problems = append(problems, "ranking weights can't be negative")
+	}
+	if c.Ranking.Gravity < 0 {
+		problems = append(problems, "ranking gravity can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// IsAdmin tells whether the user may moderate anything.
+func (c *Config) IsAdmin(username string) bool {
+	for _, admin := range c.Server.Admins {
+		if len(username) > 0 && strings.TrimSpace(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies parses the trusted proxies, a single address is a range of
+// its own.
+func (c *Config) TrustedProxies() ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(c.Server.TrustedProxies))
+	for _, entry := range c.Server.TrustedProxies {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or a CIDR range", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (c *Config) RedisAddr() string {
+	return fmt.Sprintf("%s:%d", c.Redis.Host, c.Redis.Port)
+}
+
+// Data source name for the MySQL driver. Built by the driver, so the
+// credentials don't have to be escaped.
+func (c *DatabaseConfig) DSN() string {
+	dsn := mysql.NewConfig()
+	dsn.User = c.Username
+	dsn.Passwd = c.Password
+	dsn.Net = "tcp"
+	dsn.Addr = c.Host
+	dsn.DBName = c.Name
+	dsn.ParseTime = true
+	dsn.Loc = time.Local
+	dsn.Params = map[string]string{"charset": "utf8mb4"}
+	return dsn.FormatDSN()
+}
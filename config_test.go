@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// A configuration which passes Validate.
+func validConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Database.Username = "toktik"
+	cfg.Database.Password = "toktik"
+	cfg.Database.Host = "localhost:3306"
+	cfg.Redis.Host = "localhost"
+	return cfg
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if cfg.Server.Port != 7000 || cfg.Redis.Port != 6379 || cfg.Database.Name != "toktik-db" {
+		t.Fatalf("unexpected defaults %+v", cfg)
+	}
+	if cfg.Storage.Backend != "s3" || cfg.Cache.Backend != "memory" {
+		t.Fatalf("unexpected backends %q %q", cfg.Storage.Backend, cfg.Cache.Backend)
+	}
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("defaults with credentials don't validate: %v", err)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`
+server:
+  port: 8000
+  admins: [alice]
+database:
+  username: file
+  password: file
+  host: db:3306
+redis:
+  host: redis
+storage:
+  backend: local
+  secret: file
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PORT", "9000")
+	t.Setenv("DB_PASSWORD", "env")
+	t.Setenv("UPLOAD_TTL", "2h")
+	t.Setenv("ADMINS", "bob,carol")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	t.Setenv("REDIS_PORT", "6380")
+
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9000 || cfg.Database.Password != "env" || cfg.Database.Username != "file" {
+		t.Fatalf("env didn't win over the file: %+v %+v", cfg.Server, cfg.Database)
+	}
+	if time.Duration(cfg.Upload.SessionTTL) != 2*time.Hour {
+		t.Fatalf("upload ttl = %v", time.Duration(cfg.Upload.SessionTTL))
+	}
+	if len(cfg.Server.Admins) != 2 || !cfg.IsAdmin("carol") || cfg.IsAdmin("alice") {
+		t.Fatalf("admins = %v", cfg.Server.Admins)
+	}
+	if cfg.Redis.Host != "redis" || cfg.Redis.Port != 6380 {
+		t.Fatalf("redis = %+v", cfg.Redis)
+	}
+	if cfg.Storage.URL != "http://localhost:9000/storage" {
+		t.Fatalf("storage url = %s", cfg.Storage.URL)
+	}
+}
+
+func TestLoadConfigBadEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"PORT":            "seven thousand",
+		"REDIS_PORT":      "six",
+		"UPLOAD_TTL":      "a day",
+		"UPLOAD_MAX_SIZE": "1GB",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			_, err := LoadConfig("")
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Fatalf("got %v, want %s to be refused", err, name)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		problem string
+		change  func(*Config)
+	}{
+		{"server port", func(c *Config) { c.Server.Port = 0 }},
+		{"trusted proxy", func(c *Config) { c.Server.TrustedProxies = []string{"proxy"} }},
+		{"DB_USERNAME", func(c *Config) { c.Database.Username = "" }},
+		{"DB_PASSWORD", func(c *Config) { c.Database.Password = "" }},
+		{"DB_IP", func(c *Config) { c.Database.Host = "" }},
+		{"DB_NAME", func(c *Config) { c.Database.Name = "" }},
+		{"REDIS_IP", func(c *Config) { c.Redis.Host = "" }},
+		{"redis port", func(c *Config) { c.Redis.Port = 70000 }},
+		{"STORAGE_REGION", func(c *Config) { c.Storage.Region = "" }},
+		{"STORAGE_BUCKET", func(c *Config) { c.Storage.Bucket = "" }},
+		{"STORAGE_DIR", func(c *Config) { c.Storage.Backend, c.Storage.Secret, c.Storage.Dir = "local", "secret", "" }},
+		{"STORAGE_SECRET", func(c *Config) { c.Storage.Backend = "local" }},
+		{"storage backend", func(c *Config) { c.Storage.Backend = "ftp" }},
+		{"presign expiry", func(c *Config) { c.Storage.PresignExpiry = Duration(8 * 24 * time.Hour) }},
+		{"cache size", func(c *Config) { c.Cache.Size = 0 }},
+		{"cache backend", func(c *Config) { c.Cache.Backend = "disk" }},
+		{"cache margin", func(c *Config) { c.Cache.Margin = c.Storage.PresignExpiry }},
+		{"upload session ttl", func(c *Config) { c.Upload.SessionTTL = 0 }},
+		{"upload max size", func(c *Config) { c.Upload.MaxSize = 0 }},
+		{"content type", func(c *Config) { c.Upload.ContentTypes = nil }},
+		{"outbox interval", func(c *Config) { c.Outbox.Interval = 0 }},
+		{"outbox batch size", func(c *Config) { c.Outbox.BatchSize = 0 }},
+		{"outbox max attempts", func(c *Config) { c.Outbox.MaxAttempts = 0 }},
+		{"notifications concurrency", func(c *Config) { c.Notifications.Concurrency = 0 }},
+		{"notifications batch size", func(c *Config) { c.Notifications.BatchSize = 0 }},
+		{"views window", func(c *Config) { c.Views.Window = 0 }},
+		{"views flush interval", func(c *Config) { c.Views.FlushInterval = 0 }},
+		{"views batch size", func(c *Config) { c.Views.BatchSize = 0 }},
+		{"ranking interval", func(c *Config) { c.Ranking.Interval = 0 }},
+		{"ranking size", func(c *Config) { c.Ranking.Size = 0 }},
+		{"ranking snapshot ttl", func(c *Config) { c.Ranking.SnapshotTTL = c.Ranking.Interval }},
+		{"ranking weights", func(c *Config) { c.Ranking.WatchSecondWeight = -1 }},
+		{"ranking gravity", func(c *Config) { c.Ranking.Gravity = -1 }},
+	}
+	for _, c := range cases {
+		cfg := validConfig()
+		c.change(cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("got %v, want a problem with the %s", err, c.problem)
+		}
+	}
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	cfg := DatabaseConfig{Username: "toktik", Password: "p@ss:w/rd?", Host: "db:3306", Name: "toktik-db"}
+	parsed, err := mysql.ParseDSN(cfg.DSN())
+	if err != nil {
+		t.Fatalf("%s doesn't parse: %v", cfg.DSN(), err)
+	}
+	if parsed.User != cfg.Username || parsed.Passwd != cfg.Password || parsed.Addr != cfg.Host || parsed.DBName != cfg.Name {
+		t.Fatalf("%s parsed as %+v", cfg.DSN(), parsed)
+	}
+	if !parsed.ParseTime || parsed.Loc != time.Local || parsed.Params["charset"] != "utf8mb4" {
+		t.Fatalf("%s lost its options", cfg.DSN())
+	}
+}
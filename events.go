@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/functions/crud"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// How often a stream checks on the video. A comment is sent when nothing
+// changed, so proxies don't close it.
+const eventsHeartbeat = 15 * time.Second
+
+// VideoEvent is published whenever the backend sees the status of a video
+// change. The worker publishes nothing, how far it got is only known by
+// looking at the video, which the streams do on every heartbeat.
+type VideoEvent struct {
+	// One of the STATUS_* status.
+	Status string `json:"status"`
+
+	// Percentage of the processing done.
+	Progress int `json:"progress"`
+
+	// Set when the video failed.
+	Error string `json:"error,omitempty"`
+}
+
+// The pub/sub channel a video's events are published on. Video keys are
+// unique, so the worker only needs the key it is given.
+func videoEventsChannel(videoKey string) string {
+	return fmt.Sprintf("video:%s:events", videoKey)
+}
+
+// Done tells whether nothing will follow the event.
+func (e VideoEvent) Done() bool {
+	return e.Status == STATUS_READY || e.Status == STATUS_FAILED
+}
+
+// VideoEvents publishes the events of the videos over redis.
+type VideoEvents struct {
+	Redis *redis.Client
+}
+
+func (v *VideoEvents) Publish(ctx context.Context, videoKey string, event VideoEvent) error {
+	if v == nil || v.Redis == nil {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return v.Redis.Publish(ctx, videoEventsChannel(videoKey), payload).Err()
+}
+
+// Publishes the status of the video, looking its key up.
+func (v *VideoEvents) PublishStatus(ctx context.Context, db *gorm.DB, status *VideoStatus) {
+	if v == nil {
+		return
+	}
+	vid, err := crud.GetVideo(db, status.VideoID)
+	if err != nil {
+		log.Println("Failed to get video for its event:", err)
+		return
+	}
+	err = v.Publish(ctx, vid.Key, VideoEvent{
+		Status:   status.Status,
+		Progress: status.Progress(vid),
+		Error:    status.Error,
+	})
+	if err != nil {
+		log.Println("Failed to publish video event:", err)
+	}
+}
+
+// The event describing where the video is at, reconciling its status with
+// the worker on the way.
+func (s *Server) videoEvent(vid *video.Video) (VideoEvent, error) {
+	status, err := s.videoStatus(vid)
+	if err != nil {
+		return VideoEvent{}, err
+	}
+	return VideoEvent{
+		Status:   status.Status,
+		Progress: status.Progress(vid),
+		Error:    status.Error,
+	}, nil
+}
+
+// Writes a single server-sent event.
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, name string, event VideoEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// Streams the processing of the video as server-sent events, starting with
+// its current status. The stream ends once the video is ready or failed.
+func (s *Server) HandleVideoEvents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	videoName := p.ByName("video")
+	username := p.ByName("user")
+	if len(videoName) == 0 || len(username) == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Video name/username not specified.")
+		return
+	}
+
+	if !requireOwner(w, r, username, "Only the owner can see the video's status.") {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Fail(w, r, CODE_NOT_SUPPORTED, "Streaming is not supported.")
+		return
+	}
+
+	vid, err := getUserVideo(s.DB, username, videoName)
+	if err != nil {
+		WriteError(w, r, videoLookupError(err))
+		return
+	}
+
+	// Subscribe before reading the status, so nothing published in between
+	// is missed.
+	ctx := r.Context()
+	sub := s.Redis.Subscribe(ctx, videoEventsChannel(vid.Key))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		FailInternal(w, r, err, "Failed to subscribe to video events.")
+		return
+	}
+
+	current, err := s.videoEvent(vid)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get video status.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, flusher, "status", current); err != nil || current.Done() {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-heartbeat.C:
+			// Nobody tells us about the worker's progress, go and look.
+			event := current
+			if vid, err := crud.GetVideo(s.DB, vid.ID); err != nil {
+				log.Printf("[%s] Failed to get video for its events: %v", RequestID(r), err)
+			} else if event, err = s.videoEvent(vid); err != nil {
+				log.Printf("[%s] Failed to get video status: %v", RequestID(r), err)
+				event = current
+			}
+			if event == current {
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			}
+
+			name := "progress"
+			if event.Status != current.Status {
+				name = "status"
+			}
+			current = event
+			if err := writeEvent(w, flusher, name, event); err != nil || event.Done() {
+				return
+			}
+
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			event := VideoEvent{}
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Println("Dropping malformed video event:", err)
+				continue
+			}
+			// Likely what the last heartbeat already found.
+			if event == current {
+				continue
+			}
+
+			name := "progress"
+			if event.Status != current.Status {
+				name = "status"
+			}
+			current = event
+			if err := writeEvent(w, flusher, name, event); err != nil {
+				return
+			}
+
+			// Save the final status, before the stream ends.
+			if event.Done() {
+				if vid, err := crud.GetVideo(s.DB, vid.ID); err == nil {
+					s.videoStatus(vid)
+				}
+				return
+			}
+		}
+	}
+}
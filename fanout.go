@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/models/user"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Notification fan-out tasks get their own queue, the video worker only
+// knows about the "default" one.
+const (
+	TypeNotificationFanout = "notification:fanout"
+	NOTIFICATIONS_QUEUE    = "notifications"
+)
+
+// NotificationFanoutPayload describes something every participant of a
+// video is told about.
+type NotificationFanoutPayload struct {
+	// Identifies what happened, e.g. "comment:42". A task carrying a key
+	// which was already fanned out is skipped.
+	Key string `json:"key"`
+
+	VideoID uint                   `json:"video_id"`
+	ActorID uint                   `json:"actor_id"`
+	Type    video.NotificationType `json:"type"`
+
+	// Only the owner of the video is told, not everyone involved.
+	OwnerOnly bool `json:"owner_only,omitempty"`
+}
+
+// NewNotificationFanoutTask notifies the owner of the video and everyone who
+// liked or commented on it, except for the actor. It is meant to be saved
+// in the outbox along with what caused it.
+func NewNotificationFanoutTask(key string, videoID, actorID uint, kind video.NotificationType) (*asynq.Task, error) {
+	return newNotificationFanoutTask(NotificationFanoutPayload{
+		Key:     key,
+		VideoID: videoID,
+		ActorID: actorID,
+		Type:    kind,
+	})
+}
+
+// NewOwnerNotificationTask only notifies the owner of the video, unless they
+// are the actor. It goes through the fan-out all the same, so it is
+// deduplicated and follows the owner's preferences and mutes.
+func NewOwnerNotificationTask(key string, videoID, actorID uint, kind video.NotificationType) (*asynq.Task, error) {
+	return newNotificationFanoutTask(NotificationFanoutPayload{
+		Key:       key,
+		VideoID:   videoID,
+		ActorID:   actorID,
+		Type:      kind,
+		OwnerOnly: true,
+	})
+}
+
+func newNotificationFanoutTask(fanout NotificationFanoutPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(fanout)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeNotificationFanout, payload), nil
+}
+
+// TaskHandler returns the asynq handler processing the backend's own tasks.
+func (s *Server) TaskHandler() asynq.Handler {
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(TypeNotificationFanout, s.HandleNotificationFanout)
+	return mux
+}
+
+// The next recipients of the video's notifications, by increasing id. Those
+// who muted the video or turned the kind of notification off are left out.
+func notificationRecipients(db *gorm.DB, payload *NotificationFanoutPayload, after uint, limit int) ([]uint, error) {
+	if payload.OwnerOnly {
+		db = db.Table("(SELECT user_id FROM videos WHERE id = ?) AS recipients", payload.VideoID)
+	} else {
+		db = db.Table(`(
+			SELECT user_id FROM videos WHERE id = ?
+			UNION
+			SELECT user_id FROM video_likes WHERE video_id = ? AND `+"`like`"+` = true
+			UNION
+			SELECT user_id FROM video_comments WHERE video_id = ? AND deleted_at IS NULL
+		) AS recipients`,
+			payload.VideoID, payload.VideoID, payload.VideoID,
+		)
+	}
+
+	recipients := make([]uint, 0)
+	err := wantedNotifications(db, "recipients.user_id", payload.VideoID, payload.Type).
+		Where("recipients.user_id > ? AND recipients.user_id <> ?", after, payload.ActorID).
+		Order("recipients.user_id").
+		Limit(limit).
+		Pluck("recipients.user_id", &recipients).Error
+	return recipients, err
+}
+
+// Creates the notifications of a fan-out, a batch of recipients per
+// transaction. How far it got is saved along with each batch, so a retried
+// or duplicated task carries on where the last one stopped and nobody is
+// notified twice.
+func (s *Server) HandleNotificationFanout(ctx context.Context, t *asynq.Task) error {
+	payload := &NotificationFanoutPayload{}
+	if err := json.Unmarshal(t.Payload(), payload); err != nil || len(payload.Key) == 0 {
+		return fmt.Errorf("invalid notification fan-out payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	fanout := &NotificationFanout{Key: payload.Key}
+	if err := s.DB.Where(fanout).FirstOrCreate(fanout).Error; err != nil {
+		return err
+	}
+	if fanout.CompletedAt != nil {
+		return nil
+	}
+
+	var actor string
+	err := s.DB.Model(&user.User{}).Select("username").Where("id = ?", payload.ActorID).Scan(&actor).Error
+	if err != nil {
+		return err
+	}
+
+	for {
+		created, done, err := s.fanoutBatch(fanout.ID, payload)
+		if err != nil {
+			return err
+		}
+		for i := range created {
+			s.publishNotification(&created[i], actor)
+		}
+		if done {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Notifies the next batch of recipients. Returns the notifications it made,
+// and whether everyone was notified.
+func (s *Server) fanoutBatch(fanoutID uint, payload *NotificationFanoutPayload) ([]video.VideoNotifications, bool, error) {
+	created := make([]video.VideoNotifications, 0)
+	done := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// Another worker running the same fan-out waits for this batch.
+		fanout := &NotificationFanout{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(fanout, fanoutID).Error
+		if err != nil {
+			return err
+		}
+		if fanout.CompletedAt != nil {
+			done = true
+			return nil
+		}
+
+		recipients, err := notificationRecipients(tx, payload, fanout.LastUserID, s.Config.Notifications.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{}
+		if len(recipients) < s.Config.Notifications.BatchSize {
+			done = true
+			updates["completed_at"] = now
+		}
+		if len(recipients) > 0 {
+			for _, recipient := range recipients {
+				created = append(created, video.VideoNotifications{
+					VideoID: payload.VideoID,
+					ActorID: payload.ActorID,
+					UserID:  recipient,
+					Type:    payload.Type,
+					Date:    now,
+				})
+			}
+			if err := tx.Create(&created).Error; err != nil {
+				return err
+			}
+			updates["last_user_id"] = recipients[len(recipients)-1]
+			updates["delivered"] = gorm.Expr("delivered + ?", len(recipients))
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(fanout).Updates(updates).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, fmt.Errorf("notification fan-out %d is gone: %w", fanoutID, asynq.SkipRetry)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if done {
+		log.Printf("Notification fan-out %q done.", payload.Key)
+	}
+	return created, done, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Videos returned per feed page, unless asked otherwise.
+const (
+	defaultFeedPage = 20
+	maxFeedPage     = 50
+)
+
+// Where the previous page of the feed ended, in which snapshot of the
+// ranking.
+type feedCursor struct {
+	Mode    string `json:"m"`
+	Version string `json:"v"`
+	Offset  int    `json:"o"`
+}
+
+// FeedEntry is a video of the feed along with its thumbnail.
+type FeedEntry struct {
+	Video        video.VideoWithUserEntry `json:"video"`
+	ThumbnailURL string                   `json:"thumbnail_url"`
+}
+
+// The ranking the feed is asked in, ?mode= defaults to hot.
+func feedMode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mode := r.URL.Query().Get("mode")
+	if len(mode) == 0 {
+		return RANKING_HOT, true
+	}
+	if !validRankingMode(mode) {
+		Fail(w, r, CODE_INVALID_REQUEST, fmt.Sprintf("Unknown mode %q, expected one of %s.", mode, strings.Join(rankingModes, ", ")))
+		return "", false
+	}
+	return mode, true
+}
+
+// Generates the thumbnails of the videos. Videos without one are skipped.
+func (s *Server) feedEntries(r *http.Request, vids []video.VideoWithUserEntry) []FeedEntry {
+	entries := make([]FeedEntry, 0, len(vids))
+	for _, v := range vids {
+		thumbnailUrl, err := GenerateVideoThumbnailUrl(s.Storage, v.Username, v.Key)
+		if err != nil {
+			log.Printf("[%s] Failed to generate thumbnail: %v", RequestID(r), err)
+			continue
+		}
+		entries = append(entries, FeedEntry{
+			Video:        v,
+			ThumbnailURL: thumbnailUrl,
+		})
+	}
+	return entries
+}
+
+// Pages through the feed. The first page pins the latest snapshot of the
+// ranking, the cursor keeps the following pages on it so nothing shows up
+// twice or gets skipped while the ranking moves.
+func (s *Server) HandleFeed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit, err := pageLimit(r, defaultFeedPage, maxFeedPage)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	cursor := feedCursor{}
+	if value := r.URL.Query().Get("cursor"); len(value) > 0 {
+		if err := decodeCursor(value, &cursor); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if !validRankingMode(cursor.Mode) || cursor.Offset < 0 {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid cursor.")
+			return
+		}
+		if mode := r.URL.Query().Get("mode"); len(mode) > 0 && mode != cursor.Mode {
+			Fail(w, r, CODE_INVALID_REQUEST, "The cursor is for another mode.")
+			return
+		}
+	} else {
+		mode, ok := feedMode(w, r)
+		if !ok {
+			return
+		}
+		version, err := s.Rankings.Current(r.Context(), mode)
+		if err != nil {
+			FailInternal(w, r, err, "Failed to get feed.")
+			return
+		}
+		cursor = feedCursor{Mode: mode, Version: version}
+	}
+
+	ids, total, err := s.Rankings.Page(r.Context(), cursor.Mode, cursor.Version, cursor.Offset, limit)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	vids, err := rankedVideos(s.DB, ids)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get videos.")
+		return
+	}
+
+	next := ""
+	if end := cursor.Offset + len(ids); len(ids) == limit && int64(end) < total {
+		next = encodeCursor(feedCursor{Mode: cursor.Mode, Version: cursor.Version, Offset: end})
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"mode":        cursor.Mode,
+		"entries":     s.feedEntries(r, vids),
+		"next_cursor": next,
+	})
+}
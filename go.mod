@@ -3,12 +3,20 @@ module github.com/help-me-someone/scalable-p2-backend
 go 1.18
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.0
 	github.com/aws/aws-sdk-go-v2/config v1.19.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.40.2
+	github.com/aws/smithy-go v1.15.0
 	github.com/dchest/uniuri v1.2.0
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/gorilla/websocket v1.5.0
 	github.com/help-me-someone/scalable-p2-db v0.0.0-20231115083024-3d56ac8e3498
+	github.com/help-me-someone/scalable-p2-worker v0.0.0-20231024162843-4f9ee9bb8ea4
 	github.com/hibiken/asynq v0.24.1
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/redis/go-redis/v9 v9.0.3
+	github.com/rs/cors v1.10.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -28,17 +36,12 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sso v1.15.2 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.17.3 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.23.2 // indirect
-	github.com/aws/smithy-go v1.15.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-sql-driver/mysql v1.7.1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/uuid v1.2.0 // indirect
-	github.com/help-me-someone/scalable-p2-worker v0.0.0-20231024162843-4f9ee9bb8ea4 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/redis/go-redis/v9 v9.0.3 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
-	github.com/rs/cors v1.10.1 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
 	github.com/u2takey/ffmpeg-go v0.5.0 // indirect
 	github.com/u2takey/go-utils v0.3.1 // indirect
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,34 +12,50 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/dchest/uniuri"
 
 	"github.com/help-me-someone/scalable-p2-db/functions/crud"
-	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/help-me-someone/scalable-p2-db/models/user"
 	"github.com/help-me-someone/scalable-p2-worker/worker"
-	"github.com/hibiken/asynq"
 	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
 )
 
-func FailResponse(w http.ResponseWriter, status int, message string) {
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": false,
-		"message": message,
-	})
+// Returns the user the Forwardauth authenticated, failing the request when
+// there is none.
+// NOTE: See IsAuth in auth svc.
+func requireUsername(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := r.Header.Get("X-Username")
+	if len(username) == 0 {
+		log.Println("No X-Username found in header.")
+		Fail(w, r, CODE_UNAUTHENTICATED, "Username not specified.")
+		return "", false
+	}
+	return username, true
+}
+
+// Fails the request unless it was made by owner.
+func requireOwner(w http.ResponseWriter, r *http.Request, owner, message string) bool {
+	username, ok := requireUsername(w, r)
+	if !ok {
+		return false
+	}
+	if username != owner {
+		Fail(w, r, CODE_FORBIDDEN, message)
+		return false
+	}
+	return true
 }
 
 // This API kickstarts the pipeline for saving
-func HandleVideoSave(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (s *Server) HandleVideoSave(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	log.Println("Handling video save.")
 
 	// Ensure the method is correct.
 	if r.Method != "POST" {
-		log.Println("Error: Not GET request")
-		FailResponse(w, http.StatusBadRequest, "Invalid method.")
+		log.Println("Error: Not POST request")
+		Fail(w, r, CODE_METHOD_NOT_ALLOWED, "Invalid method.")
 		return
 	}
 
@@ -46,40 +63,35 @@ func HandleVideoSave(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	// Get the connection
-	qc := r.Context().Value("queue_conn")
-	if qc == nil {
-		log.Println("Error: queue connection not specified")
-		FailResponse(w, http.StatusInternalServerError, "Queue connection not specified.")
-		return
-	}
-	queueConn, ok := qc.(*asynq.Client)
+	// The Forwardauth should send this.
+	user, ok := requireUsername(w, r)
 	if !ok {
-		log.Println("Error: queue connection invalid type")
-		FailResponse(w, http.StatusBadRequest, "Queue connection invalid type.")
 		return
 	}
 
-	// The Forwardauth should send this.
-	// NOTE: See IsAuth in auth svc.
-	user := r.Header.Get("X-Username")
-	if len(user) == 0 {
-		log.Println("No X-Username found in header.")
-		user = "user"
-	}
-
-	// Should be set by the request.
+	// Should be set by the request, it's the key the upload url was made for.
 	video_name := r.Header.Get("X-Video-Name")
 	if len(video_name) == 0 {
 		log.Println("No X-Video-Name found in header.")
-		video_name = "video-name"
+		Fail(w, r, CODE_INVALID_REQUEST, "Video key not specified.")
+		return
+	}
+
+	// Only videos uploaded through one of our urls, by the same user, can be saved.
+	session, err := s.activeUploadSession(user, video_name)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if err := s.checkUploadedVideo(r.Context(), session); err != nil {
+		WriteError(w, r, err)
+		return
 	}
 
 	// Create the task.
 	t1, err := worker.NewVideoSaveTask(user, video_name)
 	if err != nil {
-		log.Println("Error: failed to create task:", err)
-		FailResponse(w, http.StatusBadRequest, "Failed to create task.")
+		FailInternal(w, r, err, "Failed to create task.")
 		return
 	}
 	// TODO: ^^^ Clean this up, stop using headers...
@@ -91,243 +103,233 @@ func HandleVideoSave(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	}{}
 	err = json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
-		FailResponse(w, http.StatusBadRequest, "Failed to retrieve file name.")
+		Fail(w, r, CODE_INVALID_REQUEST, "Failed to retrieve file name.")
 		return
 	}
 
-	// Add the new video entry to the database
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	usr, _ := crud.GetUserByName(connection, user)
-	_, err = crud.CreateVideo(
-		connection,
-		payload.FileName,
-		video_name,
-		usr.ID,
-	)
+	// Add the new video entry to the database, along with the task which
+	// processes it. The dispatcher queues the task once this commits, so
+	// there is never a video without a task or a task without a video.
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		vid, err := crud.CreateVideo(
+			tx,
+			payload.FileName,
+			video_name,
+			session.UserID,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Create(NewOutboxTask(t1, vid.ID)).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(NewVideoStatus(vid.ID)).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&VideoStats{VideoID: vid.ID}).Error; err != nil {
+			return err
+		}
+
+		// The session is used up, the same upload can't be saved twice.
+		// Only one of two concurrent saves gets to close it, the other one
+		// is rolled back.
+		result := tx.Model(session).
+			Where("status IN ?", []string{UPLOAD_PENDING, UPLOAD_COMPLETED}).
+			Update("status", UPLOAD_SAVED)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errUploadSessionClosed
+		}
+		return nil
+	})
 	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Create user request failed.")
+		WriteError(w, r, orInternal(err, "Failed to save video."))
 		return
 	}
 
 	// Queue the task.
-	info, err := queueConn.Enqueue(t1)
-	if err != nil {
-		log.Println("Error: failed to queue task:", err)
-		FailResponse(w, http.StatusBadRequest, "Failed to queue task.")
-		return
-	}
+	s.Outbox.Notify()
 
-	re := map[string]interface{}{
-		"success": true,
+	WriteJSON(w, r, http.StatusAccepted, map[string]interface{}{
 		"message": "sucessfully enqueued task",
-		"type":    info.Type,
+		"type":    t1.Type(),
 		"user":    user,
 		"video":   video_name, // This is the video address in the bucket.
-	}
-	json.NewEncoder(w).Encode(re)
-	log.Printf(" [*] Successfully enqueued task: %+v", info)
-}
-
-// Add a new comment from user.
-func HandleVideoComment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-
-	fmt.Println("Printing from HandleVideoComment")
-
-	videoComment := &struct {
-		Comment string
-		ActorID uint
-		VideoID uint
-	}{}
-
-	videoComment.Comment = r.FormValue("comment")
-
-	if len(videoComment.Comment) == 0 {
-		return
-	}
-
-	userID, err := strconv.Atoi(r.FormValue("user_id"))
-	if err != nil {
-		log.Println("Something bad happened at HandleVideoComment [1]")
-		return
-	}
-
-	videoID, err := strconv.Atoi(r.FormValue("video_id"))
-	if err != nil {
-		log.Println("Something bad happened at HandleVideoComment [2]")
-		return
-	}
-
-	videoComment.ActorID = uint(userID)
-	videoComment.VideoID = uint(videoID)
-
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-
-	vid, err := crud.CreateVideoComment(connection, videoComment.VideoID, videoComment.ActorID, videoComment.Comment)
-	if err != nil {
-		log.Println("HandleVideoComment - Error - Failed to create video comment entry.")
-		return
-	}
-
-	// Now we need to notify everyone involved.
-	participants, err := crud.GetVideoNotificiationRecipients(connection, uint(videoID))
-
-	for _, participant := range participants {
-		crud.CreateVideoNotification(connection, uint(videoID), videoComment.ActorID, participant.UserID, video.Comment)
-	}
-
-	fmt.Printf("%+v\n", vid)
+		"status":  STATUS_UPLOADED,
+	})
+	log.Printf(" [*] Successfully saved task: %s", t1.Type())
 }
 
-func GetUploadPresignedUrl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (s *Server) GetUploadPresignedUrl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	if r.Method != "GET" {
 		log.Println("Error: Not GET request")
-		FailResponse(w, http.StatusBadRequest, "Invalid method.")
+		Fail(w, r, CODE_METHOD_NOT_ALLOWED, "Invalid method.")
 		return
 	}
 
-	username := r.Header.Get("X-Username")
-	log.Println("User requesting presigned:", username)
-
-	if len(username) == 0 {
-		log.Println("Username not specified")
-		FailResponse(w, http.StatusBadRequest, "Username not specified.")
-		return
-	}
-
-	client, err := GetS3Client(region)
-	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Failed to get s3 client.")
+	username, ok := requireUsername(w, r)
+	if !ok {
 		return
 	}
-
-	// Presign the client.
-	presignClient := s3.NewPresignClient(client)
+	log.Println("User requesting presigned:", username)
 
 	// Create the random string we'll save the file to.
-	randomKey := uniuri.NewLen(100)
+	randomKey := uniuri.NewLen(videoKeyLength)
 
 	// We save it as "vid". The directory for the video is randomly generated.
-	keyPath := fmt.Sprintf("users/%s/videos/%s/vid", username, randomKey)
+	keyPath := uploadKeyPath(username, randomKey)
 
-	response, err := presignClient.PresignPutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String("toktik-videos"),
-		Key:    aws.String(keyPath),
-	})
+	// Remember who the url was handed out to, /save checks it.
+	if _, err := s.createUploadSession(username, randomKey, ""); err != nil {
+		WriteError(w, r, err)
+		return
+	}
 
+	url, err := s.Storage.PresignPut(context.TODO(), keyPath)
 	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Error retrieving presigned object.")
+		FailInternal(w, r, err, "Error retrieving presigned object.")
 		return
 	}
 
-	resp := map[string]interface{}{
-		"success": true,
-		"url":     response.URL,
-		"key":     randomKey,
-	}
-	json.NewEncoder(w).Encode(resp)
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"url": url,
+		"key": randomKey,
+	})
 }
 
 //
 // This function deals with retrieving data from digital ocean spaces.
 //
-func VideoHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (s *Server) VideoHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
-	client, err := GetS3Client(region)
-	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Failed to get S3 client.")
-		return
-	}
+	user := strings.ToLower(p.ByName("user"))
+	resource := p.ByName("video")
+
+	s.servePlaylist(w, r, user, resource, rootPlaylist)
+}
+
+// Serves the variant playlists linked from a master playlist. Each
+// rendition (240p, 480p, ...) has its own playlist with its own segments.
+func (s *Server) VideoVariantHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	user := strings.ToLower(p.ByName("user"))
 	resource := p.ByName("video")
 
-	// Generate the HSL file.
-	buf, err := GenerateHSLFile(client, user, resource)
+	playlistPath, ok := ValidPlaylistPath(p.ByName("path"))
+	if !ok {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid playlist.")
+		return
+	}
+
+	s.servePlaylist(w, r, user, resource, playlistPath)
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, user, resource, playlistPath string) {
+	// Get the HSL file, it is only generated when it isn't cached.
+	playlist, err := s.videoPlaylist(r.Context(), user, resource, playlistPath)
+	if errors.Is(err, ErrObjectNotFound) {
+		Fail(w, r, CODE_VIDEO_NOT_FOUND, "Playlist not found.")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		resp := map[string]interface{}{
-			"success": false,
-			"message": fmt.Sprintf("failed to generate HLS file: %s", err),
-		}
-		json.NewEncoder(w).Encode(resp)
+		FailInternal(w, r, err, "Failed to generate HLS file.")
 		return
 	}
 
-	http.ServeContent(w, r, "", time.Now(), bytes.NewReader((buf.Bytes())))
+	// Players may keep the playlist as long as its urls stay valid.
+	maxAge := int(time.Until(playlist.Expires).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("ETag", playlist.ETag)
+
+	// ServeContent answers If-None-Match and If-Modified-Since for us.
+	http.ServeContent(w, r, "", playlist.ModTime, bytes.NewReader(playlist.Body))
 }
 
 // Given a request, we return enough information for the frontend to be able to
 // display it.
 // NOTE: This does not return the HLS!
-func HandleVideoInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (s *Server) HandleVideoInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// We only have the video name.
 	videoName := p.ByName("video")
 	username := p.ByName("user")
 	if len(videoName) == 0 || len(username) == 0 {
-		FailResponse(w, http.StatusBadRequest, "Video name/username not specified.")
+		Fail(w, r, CODE_INVALID_REQUEST, "Video name/username not specified.")
 		return
 	}
 
 	// Search for the entry.
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	vid, _ := crud.GetUserVideoFromUsername(connection, username, videoName)
-	likeCount := crud.GetVideoLikeCount(connection, vid.ID)
-
-	// Create the presigned url for the thumbnail.
-	thumbnailKey := fmt.Sprintf("users/%s/videos/%s/thumbnail", username, videoName)
-	client, err := GetS3Client(region)
+	vid, err := getUserVideo(s.DB, username, videoName)
 	if err != nil {
-		log.Println("Could not create s3 client.")
-		FailResponse(w, http.StatusInternalServerError, "Could not create s3 client.")
+		WriteError(w, r, videoLookupError(err))
+		return
+	}
+	stats, err := getVideoStats(s.DB, vid.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get video stats.")
 		return
 	}
 
-	url, err := GeneratePresignedUrl(thumbnailKey, client)
+	// Create the presigned url for the thumbnail.
+	thumbnailKey := fmt.Sprintf("users/%s/videos/%s/thumbnail", username, videoName)
+	url, err := GeneratePresignedUrl(thumbnailKey, s.Storage)
 	if err != nil {
-		log.Println("Failed to generate presigned url.")
-		FailResponse(w, http.StatusInternalServerError, "Failed to generate presigned url.")
+		FailInternal(w, r, err, "Failed to generate presigned url.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":   true,
-		"message":   "Video found.",
-		"video":     vid,
-		"likes":     likeCount,
-		"thumbnail": url,
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message":    "Video found.",
+		"video":      vid,
+		"likes":      stats.Likes,
+		"thumbnail":  url,
+		"engagement": videoEngagement(stats),
 	})
 }
 
 // Corresponds to the "/watch/:user/:video" URL.
 // This handler is exactly the same as the one for video info,
 // however this also increase the view count of the video.
-func HandleVideoWatchInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (s *Server) HandleVideoWatchInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// We only have the video name.
 	videoName := p.ByName("video")
 	videoOwnerUsername := p.ByName("user")
 	if len(videoName) == 0 || len(videoOwnerUsername) == 0 {
-		FailResponse(w, http.StatusBadRequest, "Video name/username not specified.")
+		Fail(w, r, CODE_INVALID_REQUEST, "Video name/username not specified.")
 		return
 	}
 
 	username := r.Header.Get("X-Username")
-	log.Println("Current active username:", username)
 
 	// Search for the entry.
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	vid, _ := crud.GetUserVideoFromUsername(connection, videoOwnerUsername, videoName)
+	vid, err := getUserVideo(s.DB, videoOwnerUsername, videoName)
+	if err != nil {
+		WriteError(w, r, videoLookupError(err))
+		return
+	}
 
 	// Search for like count.
-	likeCount := crud.GetVideoLikeCount(connection, vid.ID)
+	stats, err := getVideoStats(s.DB, vid.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get video stats.")
+		return
+	}
 
-	// Get the current active user.
-	usr, _ := crud.GetUserByName(connection, username)
-	log.Println("Current user: ", usr.Username)
+	// Get the current active user, anyone can watch without one.
+	usr := &user.User{}
+	if len(username) > 0 {
+		if found, err := crud.GetUserByName(s.DB, username); err == nil {
+			usr = found
+		}
+	}
 
-	fmt.Println("Username: ", username)
-	fmt.Println("Video Name: ", videoName)
-	videoLike, _ := crud.GetVideoLikeFromName(connection, username, videoName)
-	fmt.Printf("%+v\n", videoLike)
+	videoLike, _ := crud.GetVideoLikeFromName(s.DB, username, videoName)
 
 	isLiked := false
 	if videoLike != nil {
@@ -336,206 +338,148 @@ func HandleVideoWatchInfo(w http.ResponseWriter, r *http.Request, p httprouter.P
 
 	// Create the presigned url for the thumbnail.
 	thumbnailKey := fmt.Sprintf("users/%s/videos/%s/thumbnail", videoOwnerUsername, videoName)
-	client, err := GetS3Client(region)
+	url, err := GeneratePresignedUrl(thumbnailKey, s.Storage)
 	if err != nil {
-		log.Println("Could not create s3 client.")
-		FailResponse(w, http.StatusInternalServerError, "Could not create s3 client.")
+		FailInternal(w, r, err, "Failed to generate presigned url.")
 		return
 	}
 
-	url, err := GeneratePresignedUrl(thumbnailKey, client)
-	if err != nil {
-		log.Println("Failed to generate presigned url.")
-		FailResponse(w, http.StatusInternalServerError, "Failed to generate presigned url.")
-		return
+	// Count the view, the video is still worth showing when it can't be.
+	if _, err := s.Views.Record(r.Context(), vid.ID, s.requestViewer(r, usr)); err != nil {
+		log.Printf("[%s] Failed to count view: %v", RequestID(r), err)
 	}
 
-	// Increment the view count of the video.
-	err = crud.UpdateVideoViewIncrement(connection, vid.ID)
-	if err != nil {
-		log.Println("Failed to increment video view count.")
-		FailResponse(w, http.StatusBadRequest, "Failed to increment video view count")
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":    true,
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
 		"message":    "Video found.",
 		"video":      vid,
 		"thumbnail":  url,
-		"like_count": likeCount,
+		"like_count": stats.Likes,
 		"uid":        usr.ID,
 		"liked":      isLiked,
+		"engagement": videoEngagement(stats),
 	})
 }
 
 // The VideoFeedHandler handles when the frontend requests for content on the home page.
 // The content is going to be used for the infinite scrolling on the frontend side.
 // This will simply return a bunch of videos. With their thumbnail's url.
-func VideoFeedHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// Pages are taken from the latest ranking, HandleFeed's cursors keep scrolling
+// on the same one.
+func (s *Server) VideoFeedHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	// Attempt to get the query values.
 	amountStr := p.ByName("amount")
 	pageStr := p.ByName("page")
 	if len(amountStr) == 0 || len(pageStr) == 0 {
-		FailResponse(w, http.StatusBadRequest, "Failed to get videos.")
+		Fail(w, r, CODE_INVALID_REQUEST, "Amount/page not specified.")
 		return
 	}
 
 	// Convert query into numerical values.
 	amount, err := strconv.Atoi(amountStr)
+	if err != nil || amount < 0 || amount > maxFeedPage {
+		Fail(w, r, CODE_INVALID_REQUEST, fmt.Sprintf("Amount must be between 0 and %d.", maxFeedPage))
+		return
+	}
 	page, err := strconv.Atoi(pageStr)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "Failed to get videos.",
-		})
+	if err != nil || page < 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid page.")
 		return
 	}
 
-	// Create a new connection
-
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	vids, err := crud.GetTopPopularVideos(connection, page, amount)
-
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "Failed to get videos.",
-		})
+	mode, ok := feedMode(w, r)
+	if !ok {
 		return
 	}
 
-	// Create a new S3 client.
-	client, err := GetS3Client(region)
+	// The page is where the feed starts, not a page number.
+	ids, err := s.Rankings.Ranked(r.Context(), mode, page, amount)
 	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Failed to get an S3 client.")
-	}
-
-	// Generate the response for the frontend.
-	// For each video, we just generate the video thumbnail.
-	type Entry struct {
-		Video        video.VideoWithUserEntry `json:"video"`
-		ThumbnailURL string                   `json:"thumbnail_url"`
+		FailInternal(w, r, err, "Failed to get feed.")
+		return
 	}
-	entries := make([]Entry, 0)
-	for _, v := range vids {
-		thumbnailUrl, err := GenerateVideoThumbnailUrl(client, v.Username, v.Key)
-		if err != nil {
-			log.Println("Something went wrong.")
-			continue
-		}
-		entries = append(entries, Entry{
-			Video:        v,
-			ThumbnailURL: thumbnailUrl,
-		})
+	vids, err := rankedVideos(s.DB, ids)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get videos.")
+		return
 	}
 
 	// Send the response.
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
 		"message": "Successfully retrieved feed.",
-		"entries": entries,
+		"entries": s.feedEntries(r, vids),
 	})
 }
 
-func GetVideoByRank(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (s *Server) GetVideoByRank(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	log.Println("Getting video by rank.")
 
 	// Attempt to get the query values.
 	rankStr := p.ByName("rank")
-	if len(rankStr) == 0 {
-		FailResponse(w, http.StatusBadRequest, "Failed to get videos.")
+	rank, err := strconv.Atoi(rankStr)
+	if err != nil || rank < 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid rank.")
 		return
 	}
 
-	// Get connection.
-	connection, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
+	mode, ok := feedMode(w, r)
+	if !ok {
+		return
+	}
 
-	// Query the database.
-	rank, _ := strconv.Atoi(rankStr)
-	vid, err := crud.GetVideoByRank(connection, rank)
+	ids, err := s.Rankings.Ranked(r.Context(), mode, rank, 1)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "Video not found.",
-		})
+		FailInternal(w, r, err, "Failed to get feed.")
 		return
 	}
-
-	// Create a new S3 client.
-	client, err := GetS3Client(region)
+	vids, err := rankedVideos(s.DB, ids)
 	if err != nil {
-		FailResponse(w, http.StatusInternalServerError, "Failed to get an S3 client.")
-		log.Panicln("Failed to generate S3 client.")
+		FailInternal(w, r, err, "Failed to get video.")
 		return
 	}
+	if len(vids) == 0 {
+		Fail(w, r, CODE_VIDEO_NOT_FOUND, "Video not found.")
+		return
+	}
+	vid := &vids[0]
 
 	// Generate the response for the frontend.
 	// For each video, we just generate the video thumbnail.
-	thumbnailUrl, err := GenerateVideoThumbnailUrl(client, vid.Username, vid.Key)
+	thumbnailUrl, err := GenerateVideoThumbnailUrl(s.Storage, vid.Username, vid.Key)
 	if err != nil {
-		log.Println("Failed to generate thumbnail.")
+		FailInternal(w, r, err, "Failed to generate thumbnail.")
 		return
 	}
 
-	type Entry struct {
-		Video        video.VideoWithUserEntry `json:"video"`
-		ThumbnailURL string                   `json:"thumbnail_url"`
-	}
-	entry := &Entry{
+	entry := &FeedEntry{
 		Video:        *vid,
 		ThumbnailURL: thumbnailUrl,
 	}
 
 	// Send the response.
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
 		"message": "Successfully retrieved feed.",
 		"entry":   entry,
 	})
 }
 
-func GetUserVideos(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// Make a new database client
-	connection, err := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "Failed to get the database connection.",
-		})
-		return
-	}
-
+func (s *Server) GetUserVideos(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// Retrieve the username
 	username := p.ByName("user")
 	if len(username) == 0 {
-		log.Println("Where the username be at??")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "No username specified",
-		})
+		Fail(w, r, CODE_INVALID_REQUEST, "No username specified.")
 		return
 	}
 
 	// Retrieve the user's vidoes.
-	videos, err := crud.GetUserVideosFromUsername(connection, username)
+	videos, err := crud.GetUserVideosFromUsername(s.DB, username)
 	if err != nil {
-		log.Println("Something bad has truly happened.")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "Failed to get user's videos.",
-			"videos":  videos,
-		})
+		FailInternal(w, r, err, "Failed to get user's videos.")
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
 		"message": "Successfully retrieved user videos.",
 		"videos":  videos,
 	})
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/help-me-someone/scalable-p2-worker/worker"
+	"github.com/hibiken/asynq"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeQueue records the tasks instead of sending them to redis.
+type fakeQueue struct {
+	tasks []*asynq.Task
+	ids   []string
+}
+
+func (q *fakeQueue) Enqueue(task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	info := &asynq.TaskInfo{Type: task.Type(), Payload: task.Payload(), Queue: "default"}
+	for _, opt := range opts {
+		switch opt.Type() {
+		case asynq.TaskIDOpt:
+			info.ID = opt.Value().(string)
+		case asynq.QueueOpt:
+			info.Queue = opt.Value().(string)
+		}
+	}
+	q.tasks = append(q.tasks, task)
+	q.ids = append(q.ids, info.ID)
+	return info, nil
+}
+
+// fakeInspector answers with the state it was given for every task.
+type fakeInspector struct {
+	state   asynq.TaskState
+	lastErr string
+	err     error
+}
+
+func (i *fakeInspector) GetTaskInfo(queue, id string) (*asynq.TaskInfo, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	return &asynq.TaskInfo{ID: id, Queue: queue, State: i.state, LastErr: i.lastErr}, nil
+}
+
+// Opens gorm on top of a mocked mysql connection.
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	return newMockDBMatching(t, sqlmock.QueryMatcherRegexp)
+}
+
+// Same as newMockDB, the matcher sees every query which is run.
+func newMockDBMatching(t *testing.T, matcher sqlmock.QueryMatcher) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(matcher))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      conn,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, mock
+}
+
+// Enough of an mp4 header for the content type to be sniffed.
+var testVideo = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 64)...)
+
+// A server with a mocked database, a fake queue and a local storage holding
+// bob's upload.
+func newSaveTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, *fakeQueue) {
+	t.Helper()
+
+	db, mock := newMockDB(t)
+	store, err := NewLocalStorage(t.TempDir(), "http://localhost/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(store.Root, filepath.FromSlash(uploadKeyPath("bob", "abc")))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	queue := &fakeQueue{}
+	s := &Server{
+		Config:  cfg,
+		DB:      db,
+		Queue:   queue,
+		Storage: store,
+		Outbox:  NewOutboxDispatcher(db, queue, nil, cfg.Outbox),
+	}
+	return s, mock, queue
+}
+
+func expectUploadSession(mock sqlmock.Sqlmock, username, status string) {
+	rows := sqlmock.NewRows([]string{"id", "key", "user_id", "username", "upload_id", "status", "expires_at"}).
+		AddRow(1, "abc", 3, username, "", status, time.Now().Add(time.Hour))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `upload_sessions`")).WillReturnRows(rows)
+}
+
+func saveRequest(username string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/save", strings.NewReader(`{"file_name": "holiday.mp4"}`))
+	r.Header.Set("X-Username", username)
+	r.Header.Set("X-Video-Name", "abc")
+	return r
+}
+
+func TestHandleVideoSave(t *testing.T) {
+	s, mock, queue := newSaveTestServer(t)
+
+	expectUploadSession(mock, "bob", UPLOAD_PENDING)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `videos`")).WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `outbox_tasks`")).WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_statuses`")).WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `upload_sessions` SET `status`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := httptest.NewRecorder()
+	s.HandleVideoSave(w, saveRequest("bob"), nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("save returned %d: %s", w.Code, w.Body)
+	}
+
+	// Nothing is queued until the dispatcher picks the task up.
+	if len(queue.tasks) != 0 {
+		t.Fatalf("queued %d tasks before the outbox was dispatched", len(queue.tasks))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := worker.NewVideoSaveTask("bob", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `outbox_tasks`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "type", "payload", "video_id", "status", "attempts", "next_attempt_at"}).
+			AddRow(11, task.Type(), task.Payload(), 7, OUTBOX_PENDING, 0, time.Now()),
+	)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `outbox_tasks`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_statuses`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "video_id", "status"}).AddRow(5, 7, STATUS_UPLOADED),
+	)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_statuses`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	count, err := s.Outbox.dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(queue.tasks) != 1 {
+		t.Fatalf("dispatched %d tasks, queued %d", count, len(queue.tasks))
+	}
+	if got := queue.tasks[0]; got.Type() != worker.TypeVideoSave || !bytes.Equal(got.Payload(), task.Payload()) {
+		t.Fatalf("queued %s %s", got.Type(), got.Payload())
+	}
+	if queue.ids[0] != outboxTaskID(11) {
+		t.Fatalf("queued as %q", queue.ids[0])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Multipart uploads carry no content type, the .mov is told by its bytes.
+func TestHandleVideoSaveMultipart(t *testing.T) {
+	movie := "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  " + strings.Repeat("\x00", 64)
+	key := uploadKeyPath("bob", "abc")
+	store, uploadID, parts := uploadLocalParts(t, key, movie[:20], movie[20:])
+	if err := store.CompleteMultipartUpload(context.Background(), key, uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock := newMockDB(t)
+	cfg := DefaultConfig()
+	s := &Server{Config: cfg, DB: db, Storage: store, Outbox: NewOutboxDispatcher(db, &fakeQueue{}, nil, cfg.Outbox)}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `upload_sessions`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "key", "user_id", "username", "upload_id", "status", "expires_at"}).
+			AddRow(1, "abc", 3, "bob", uploadID, UPLOAD_COMPLETED, time.Now().Add(time.Hour)),
+	)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `videos`")).WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `outbox_tasks`")).WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_statuses`")).WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `upload_sessions` SET `status`=?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := httptest.NewRecorder()
+	s.HandleVideoSave(w, saveRequest("bob"), nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("save returned %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSniffVideoType(t *testing.T) {
+	cases := []struct {
+		head string
+		want string
+	}{
+		{string(testVideo), "video/mp4"},
+		{"\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  ", "video/quicktime"},
+		{"\x00\x00\x00\x08wide\x00\x00\x00\x00mdat", "video/quicktime"},
+		{"\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm", "video/webm"},
+		{"\x1a\x45\xdf\xa3\xa3\x42\x86\x81\x01\x42\x82\x88matroska", "video/x-matroska"},
+		{"<html><body>not a video</body></html>", "text/html"},
+		{"", "text/plain"},
+	}
+	for _, c := range cases {
+		if got := sniffVideoType([]byte(c.head)); got != c.want {
+			t.Errorf("%q sniffed as %s, want %s", c.head, got, c.want)
+		}
+	}
+}
+
+// Two saves of the same upload race, the one which gets to the session
+// second is rolled back.
+func TestHandleVideoSaveConcurrent(t *testing.T) {
+	s, mock, queue := newSaveTestServer(t)
+
+	expectUploadSession(mock, "bob", UPLOAD_PENDING)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `videos`")).WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `outbox_tasks`")).WillReturnResult(sqlmock.NewResult(12, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_statuses`")).WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `upload_sessions` SET `status`=?")).
+		WithArgs(UPLOAD_SAVED, sqlmock.AnyArg(), UPLOAD_PENDING, UPLOAD_COMPLETED, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	s.HandleVideoSave(w, saveRequest("bob"), nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("save returned %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Error struct {
+			Code ErrorCode `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Error.Code != CODE_UPLOAD_CLOSED {
+		t.Fatalf("returned %q", body.Error.Code)
+	}
+	if len(queue.tasks) != 0 {
+		t.Fatal("a task was queued")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleVideoSaveRejects(t *testing.T) {
+	cases := []struct {
+		name     string
+		username string
+		owner    string
+		status   string
+		code     ErrorCode
+	}{
+		{"someone else's upload", "eve", "bob", UPLOAD_PENDING, CODE_UPLOAD_NOT_FOUND},
+		{"already saved", "bob", "bob", UPLOAD_SAVED, CODE_UPLOAD_CLOSED},
+		{"aborted", "bob", "bob", UPLOAD_ABORTED, CODE_UPLOAD_CLOSED},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, mock, queue := newSaveTestServer(t)
+			expectUploadSession(mock, c.owner, c.status)
+
+			w := httptest.NewRecorder()
+			s.HandleVideoSave(w, saveRequest(c.username), nil)
+
+			var body struct {
+				Error struct {
+					Code ErrorCode `json:"code"`
+				} `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Error.Code != c.code {
+				t.Fatalf("returned %d %q, want %q", w.Code, body.Error.Code, c.code)
+			}
+			if len(queue.tasks) != 0 {
+				t.Fatal("a task was queued")
+			}
+			// Nothing was written.
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReconcileVideoStatus(t *testing.T) {
+	queued := &VideoStatus{Status: STATUS_QUEUED, TaskID: "outbox-1", Queue: "default"}
+	cases := []struct {
+		name      string
+		progress  uint8
+		inspector *fakeInspector
+		want      string
+		reason    string
+	}{
+		{"worker finished", video.VIDEO_READY, &fakeInspector{state: asynq.TaskStatePending}, STATUS_READY, ""},
+		{"worker started", video.VIDEO_CHUNKING, &fakeInspector{state: asynq.TaskStatePending}, STATUS_PROCESSING, ""},
+		{"still pending", video.VIDEO_CONVERTING, &fakeInspector{state: asynq.TaskStatePending}, STATUS_QUEUED, ""},
+		{"picked up", video.VIDEO_CONVERTING, &fakeInspector{state: asynq.TaskStateActive}, STATUS_PROCESSING, ""},
+		{"gave up", video.VIDEO_CONVERTING, &fakeInspector{state: asynq.TaskStateArchived, lastErr: "ffmpeg died"}, STATUS_FAILED, "ffmpeg died"},
+		{"task expired", video.VIDEO_CONVERTING, &fakeInspector{err: asynq.ErrTaskNotFound}, STATUS_QUEUED, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{Inspector: c.inspector}
+			vid := &video.Video{Status: c.progress}
+			to, reason := s.reconcileVideoStatus(vid, queued)
+			if to != c.want || reason != c.reason {
+				t.Fatalf("got %q %q, want %q %q", to, reason, c.want, c.reason)
+			}
+		})
+	}
+}
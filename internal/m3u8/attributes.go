@@ -0,0 +1,100 @@
+package m3u8
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attribute is a single NAME=VALUE pair of an attribute list. Quoted
+// values are stored without their quotes.
+type Attribute struct {
+	Key    string
+	Value  string
+	Quoted bool
+}
+
+// Attributes is an attribute list such as
+// `BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"`.
+// The order is kept so lists are written back the way they were read.
+type Attributes []Attribute
+
+// ParseAttributes parses the value of a tag holding an attribute list.
+func ParseAttributes(value string) (Attributes, error) {
+	attrs := make(Attributes, 0)
+	for len(value) > 0 {
+		eq := strings.IndexByte(value, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid attribute list %q", value)
+		}
+		attr := Attribute{Key: strings.TrimSpace(value[:eq])}
+		value = value[eq+1:]
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string in attribute %s", attr.Key)
+			}
+			attr.Value = value[1 : end+1]
+			attr.Quoted = true
+			value = value[end+2:]
+		} else {
+			end := strings.IndexByte(value, ',')
+			if end < 0 {
+				end = len(value)
+			}
+			attr.Value = strings.TrimSpace(value[:end])
+			value = value[end:]
+		}
+		attrs = append(attrs, attr)
+
+		if len(value) > 0 {
+			if value[0] != ',' {
+				return nil, fmt.Errorf("expected ',' after attribute %s", attr.Key)
+			}
+			value = value[1:]
+		}
+	}
+	return attrs, nil
+}
+
+// Get returns the value of the attribute named key.
+func (a Attributes) Get(key string) (string, bool) {
+	for _, attr := range a {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of the attribute named key, adding it at the end
+// when it isn't present yet.
+func (a *Attributes) Set(key, value string, quoted bool) {
+	for i := range *a {
+		if (*a)[i].Key == key {
+			(*a)[i].Value = value
+			(*a)[i].Quoted = quoted
+			return
+		}
+	}
+	*a = append(*a, Attribute{Key: key, Value: value, Quoted: quoted})
+}
+
+func (a Attributes) String() string {
+	var b strings.Builder
+	for i, attr := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(attr.Key)
+		b.WriteByte('=')
+		if attr.Quoted {
+			b.WriteByte('"')
+			b.WriteString(attr.Value)
+			b.WriteByte('"')
+		} else {
+			b.WriteString(attr.Value)
+		}
+	}
+	return b.String()
+}
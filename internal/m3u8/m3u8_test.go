@@ -0,0 +1,256 @@
+package m3u8
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func parseFixture(t *testing.T, name string) *Playlist {
+	t.Helper()
+	p, err := Parse(bytes.NewReader(readFixture(t, name)))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return p
+}
+
+// The fixtures are written the way WriteTo writes them, so reading and
+// writing them again must give back the same bytes and the same playlist.
+func TestRoundTrip(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+
+	for _, fixture := range fixtures {
+		name := filepath.Base(fixture)
+		t.Run(name, func(t *testing.T) {
+			data := readFixture(t, name)
+			first, err := Parse(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var written bytes.Buffer
+			n, err := first.WriteTo(&written)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(written.Len()) {
+				t.Errorf("WriteTo returned %d, wrote %d bytes", n, written.Len())
+			}
+			if !bytes.Equal(written.Bytes(), data) {
+				t.Fatalf("written playlist differs from the fixture:\n%s\nwant:\n%s", written.Bytes(), data)
+			}
+
+			second, err := Parse(bytes.NewReader(written.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(first, second) {
+				t.Fatalf("playlist changed after a round trip:\n%+v\nwant:\n%+v", second, first)
+			}
+			if second.String() != written.String() {
+				t.Fatal("second round trip isn't stable")
+			}
+		})
+	}
+}
+
+func TestParseMedia(t *testing.T) {
+	p := parseFixture(t, "media.m3u8")
+
+	if p.IsMaster() {
+		t.Fatal("media playlist parsed as a master playlist")
+	}
+	if p.Version != 7 || p.TargetDuration != 6 || p.PlaylistType != "VOD" || !p.EndList || !p.IndependentSegments {
+		t.Fatalf("bad header: %+v", p)
+	}
+	wantTags := []Tag{
+		{Name: "EXT-X-ALLOW-CACHE", Value: "YES", HasValue: true},
+		{Name: "EXT-X-START", Value: `TIME-OFFSET=2.5,PRECISE=YES,X-CUSTOM="start"`, HasValue: true},
+	}
+	if !reflect.DeepEqual(p.Tags, wantTags) {
+		t.Fatalf("tags = %+v, want %+v", p.Tags, wantTags)
+	}
+
+	if len(p.Segments) != 4 {
+		t.Fatalf("got %d segments", len(p.Segments))
+	}
+	first := p.Segments[0]
+	if first.URI != "vid0.m4s" || first.Duration != 6 || first.ProgramDateTime != "2023-11-01T10:00:00.000Z" {
+		t.Fatalf("bad first segment: %+v", first)
+	}
+	if first.Key == nil || first.Key.Method != "AES-128" || first.Key.URI != "keys/key0.bin" || first.Key.IV != "0x00000000000000000000000000000001" {
+		t.Fatalf("bad key: %+v", first.Key)
+	}
+	if first.Map == nil || first.Map.URI != "init.mp4" {
+		t.Fatalf("bad map: %+v", first.Map)
+	}
+
+	// Unknown tags stay in front of the segment they were in front of.
+	second := p.Segments[1]
+	wantSegmentTags := []Tag{
+		{Name: "EXT-X-CUE-OUT", Value: "DURATION=30", HasValue: true},
+		{Name: "EXT-X-CUSTOM-MARKER"},
+	}
+	if !reflect.DeepEqual(second.Tags, wantSegmentTags) {
+		t.Fatalf("segment tags = %+v, want %+v", second.Tags, wantSegmentTags)
+	}
+	if second.Title != "intro" || second.ByteRange == nil || *second.ByteRange != (ByteRange{Length: 1000, HasOffset: true}) {
+		t.Fatalf("bad second segment: %+v", second)
+	}
+
+	ad := p.Segments[2]
+	if !ad.Discontinuity || ad.Duration != 4.5 || ad.Map == nil || ad.Map.ByteRange == nil || ad.Map.ByteRange.Length != 720 {
+		t.Fatalf("bad third segment: %+v", ad)
+	}
+	if last := p.Segments[3]; last.Key == nil || last.Key.Method != "NONE" || len(last.Key.URI) > 0 {
+		t.Fatalf("bad last segment: %+v", last)
+	}
+
+	wantTrailing := []Tag{{Name: "EXT-X-CUE-IN"}}
+	if !reflect.DeepEqual(p.TrailingTags, wantTrailing) {
+		t.Fatalf("trailing tags = %+v, want %+v", p.TrailingTags, wantTrailing)
+	}
+}
+
+func TestParseMaster(t *testing.T) {
+	p := parseFixture(t, "master.m3u8")
+
+	if !p.IsMaster() {
+		t.Fatal("master playlist parsed as a media playlist")
+	}
+	wantTags := []Tag{
+		{Name: "EXT-X-SESSION-DATA", Value: `DATA-ID="com.example.title",VALUE="Holiday"`, HasValue: true},
+		{Name: "EXT-X-CUSTOM-MASTER", Value: `"kept"`, HasValue: true},
+	}
+	if !reflect.DeepEqual(p.Tags, wantTags) {
+		t.Fatalf("tags = %+v, want %+v", p.Tags, wantTags)
+	}
+
+	if len(p.Variants) != 2 {
+		t.Fatalf("got %d variants", len(p.Variants))
+	}
+	hd := p.Variants[0]
+	if hd.URI != "720p/index.m3u8" || hd.Bandwidth() != 2000000 || hd.Resolution() != "1280x720" {
+		t.Fatalf("bad variant: %+v", hd)
+	}
+	// Attributes the package doesn't know are kept, in order.
+	if value, ok := hd.Attributes.Get("X-SCORE"); !ok || value != "0.5" {
+		t.Fatalf("X-SCORE = %q %v", value, ok)
+	}
+	if codecs, _ := hd.Attributes.Get("CODECS"); codecs != "avc1.64001f,mp4a.40.2" {
+		t.Fatalf("CODECS = %q", codecs)
+	}
+	if hd.Attributes[len(hd.Attributes)-1].Key != "X-SCORE" {
+		t.Fatalf("attribute order changed: %s", hd.Attributes)
+	}
+
+	if len(p.IFrameVariants) != 1 || p.IFrameVariants[0].URI != "720p/iframes.m3u8" {
+		t.Fatalf("bad i-frame variants: %+v", p.IFrameVariants)
+	}
+
+	if len(p.Renditions) != 2 {
+		t.Fatalf("got %d renditions", len(p.Renditions))
+	}
+	if uri, ok := p.Renditions[0].URI(); !ok || uri != "audio/en.m3u8" {
+		t.Fatalf("rendition uri = %q %v", uri, ok)
+	}
+	if custom, _ := p.Renditions[0].Attributes.Get("X-CUSTOM"); custom != "yes" {
+		t.Fatalf("X-CUSTOM = %q", custom)
+	}
+	if _, ok := p.Renditions[1].URI(); ok {
+		t.Fatal("closed captions have a uri")
+	}
+}
+
+// Playlists written by someone else come out in our order, and stay that
+// way from then on.
+func TestWriteNormalizes(t *testing.T) {
+	input := strings.Join([]string{
+		"#EXTM3U",
+		"",
+		"# made by hand",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXTINF:4,",
+		"#EXT-X-BYTERANGE:200",
+		"  seg0.ts  ",
+		"#EXTINF:3.5,",
+		"seg1.ts",
+	}, "\r\n")
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXTINF:4.000000,",
+		"#EXT-X-BYTERANGE:200",
+		"seg0.ts",
+		"#EXTINF:3.500000,",
+		"seg1.ts",
+		"",
+	}, "\n")
+
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	again, err := Parse(strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != want {
+		t.Fatal("normalized playlist isn't stable")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"empty":                "",
+		"no header":            "#EXT-X-VERSION:3\n",
+		"uri without extinf":   "#EXTM3U\nvid0.ts\n",
+		"extinf without uri":   "#EXTM3U\n#EXTINF:4,\n",
+		"stream without uri":   "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n",
+		"bad duration":         "#EXTM3U\n#EXTINF:four,\nvid0.ts\n",
+		"bad byte range":       "#EXTM3U\n#EXTINF:4,\n#EXT-X-BYTERANGE:a@b\nvid0.ts\n",
+		"key without method":   "#EXTM3U\n#EXT-X-KEY:URI=\"key\"\n#EXTINF:4,\nvid0.ts\n",
+		"map without uri":      "#EXTM3U\n#EXT-X-MAP:BYTERANGE=\"1@0\"\n#EXTINF:4,\nvid0.ts\n",
+		"unterminated quote":   "#EXTM3U\n#EXT-X-STREAM-INF:CODECS=\"avc1\nvid.m3u8\n",
+		"bad target duration":  "#EXTM3U\n#EXT-X-TARGETDURATION:six\n",
+		"attribute without eq": "#EXTM3U\n#EXT-X-MEDIA:TYPE\n",
+	}
+	for name, input := range cases {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("")); !errors.Is(err, ErrNotPlaylist) {
+		t.Errorf("empty input returned %v, want ErrNotPlaylist", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package m3u8 parses and writes HLS playlists.
+//
+// Both media playlists (a list of segments) and master playlists (a list of
+// variants) are represented by Playlist. Tags the package does not know are
+// kept as is, so a parsed playlist can be written back without losing them.
+package m3u8
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Playlist is either a media or a master playlist, see IsMaster.
+type Playlist struct {
+	// #EXT-X-VERSION, 0 when missing.
+	Version int
+
+	// #EXT-X-INDEPENDENT-SEGMENTS.
+	IndependentSegments bool
+
+	// Playlist level tags which aren't understood, in order.
+	Tags []Tag
+
+	//
+	// Media playlist.
+	//
+
+	// #EXT-X-TARGETDURATION, in seconds.
+	TargetDuration int
+
+	// #EXT-X-MEDIA-SEQUENCE.
+	MediaSequence int
+
+	// #EXT-X-DISCONTINUITY-SEQUENCE.
+	DiscontinuitySequence int
+
+	// #EXT-X-PLAYLIST-TYPE, "VOD", "EVENT" or empty.
+	PlaylistType string
+
+	// #EXT-X-ENDLIST.
+	EndList bool
+
+	Segments []*Segment
+
+	// Unknown tags after the last segment.
+	TrailingTags []Tag
+
+	//
+	// Master playlist.
+	//
+
+	// #EXT-X-STREAM-INF, one per rendition.
+	Variants []*Variant
+
+	// #EXT-X-I-FRAME-STREAM-INF, the uri is the URI attribute.
+	IFrameVariants []*Variant
+
+	// #EXT-X-MEDIA, alternative audio, subtitles...
+	Renditions []*Rendition
+}
+
+// IsMaster reports whether the playlist lists variants instead of segments.
+func (p *Playlist) IsMaster() bool {
+	return len(p.Variants) > 0 || len(p.IFrameVariants) > 0 || len(p.Renditions) > 0
+}
+
+// Segment is a single media segment of a media playlist.
+type Segment struct {
+	URI string
+
+	// #EXTINF duration in seconds and optional title.
+	Duration float64
+	Title    string
+
+	// #EXT-X-BYTERANGE, nil when the whole resource is the segment.
+	ByteRange *ByteRange
+
+	// #EXT-X-DISCONTINUITY before the segment.
+	Discontinuity bool
+
+	// #EXT-X-KEY appearing right before this segment. The key applies to
+	// every following segment until the next one.
+	Key *Key
+
+	// #EXT-X-MAP appearing right before this segment.
+	Map *Map
+
+	// #EXT-X-PROGRAM-DATE-TIME, kept verbatim.
+	ProgramDateTime string
+
+	// Unknown tags appearing before the segment, in order.
+	Tags []Tag
+}
+
+// ByteRange is the "<length>[@<offset>]" value of #EXT-X-BYTERANGE.
+type ByteRange struct {
+	Length int64
+
+	// Offset is only written when HasOffset is set, otherwise the range
+	// starts where the previous one ended.
+	Offset    int64
+	HasOffset bool
+}
+
+func parseByteRange(value string) (*ByteRange, error) {
+	length, offset, hasOffset := value, "", false
+	if i := strings.IndexByte(value, '@'); i >= 0 {
+		length, offset, hasOffset = value[:i], value[i+1:], true
+	}
+
+	r := &ByteRange{HasOffset: hasOffset}
+	var err error
+	if r.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid byte range %q", value)
+	}
+	if hasOffset {
+		if r.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+	return r, nil
+}
+
+func (r *ByteRange) String() string {
+	if r.HasOffset {
+		return fmt.Sprintf("%d@%d", r.Length, r.Offset)
+	}
+	return strconv.FormatInt(r.Length, 10)
+}
+
+// Key is #EXT-X-KEY, the encryption of the following segments.
+type Key struct {
+	// "NONE", "AES-128" or "SAMPLE-AES".
+	Method string
+
+	// Where the key is fetched from, empty when Method is "NONE".
+	URI string
+
+	IV                string
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+func parseKey(value string) (*Key, error) {
+	attrs, err := ParseAttributes(value)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{}
+	key.Method, _ = attrs.Get("METHOD")
+	key.URI, _ = attrs.Get("URI")
+	key.IV, _ = attrs.Get("IV")
+	key.KeyFormat, _ = attrs.Get("KEYFORMAT")
+	key.KeyFormatVersions, _ = attrs.Get("KEYFORMATVERSIONS")
+	if len(key.Method) == 0 {
+		return nil, fmt.Errorf("#EXT-X-KEY without METHOD")
+	}
+	return key, nil
+}
+
+func (k *Key) String() string {
+	attrs := Attributes{{Key: "METHOD", Value: k.Method}}
+	if len(k.URI) > 0 {
+		attrs.Set("URI", k.URI, true)
+	}
+	if len(k.IV) > 0 {
+		attrs.Set("IV", k.IV, false)
+	}
+	if len(k.KeyFormat) > 0 {
+		attrs.Set("KEYFORMAT", k.KeyFormat, true)
+	}
+	if len(k.KeyFormatVersions) > 0 {
+		attrs.Set("KEYFORMATVERSIONS", k.KeyFormatVersions, true)
+	}
+	return attrs.String()
+}
+
+// Map is #EXT-X-MAP, the initialization section of the following segments.
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+func parseMap(value string) (*Map, error) {
+	attrs, err := ParseAttributes(value)
+	if err != nil {
+		return nil, err
+	}
+	m := &Map{}
+	var ok bool
+	if m.URI, ok = attrs.Get("URI"); !ok {
+		return nil, fmt.Errorf("#EXT-X-MAP without URI")
+	}
+	if byteRange, ok := attrs.Get("BYTERANGE"); ok {
+		if m.ByteRange, err = parseByteRange(byteRange); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Map) String() string {
+	attrs := Attributes{{Key: "URI", Value: m.URI, Quoted: true}}
+	if m.ByteRange != nil {
+		attrs.Set("BYTERANGE", m.ByteRange.String(), true)
+	}
+	return attrs.String()
+}
+
+// Variant is a rendition listed by a master playlist.
+type Variant struct {
+	// BANDWIDTH, RESOLUTION, CODECS...
+	Attributes Attributes
+
+	// The media playlist of the variant. For I-frame variants this is the
+	// URI attribute.
+	URI string
+}
+
+// Bandwidth returns the BANDWIDTH attribute, 0 when missing or invalid.
+func (v *Variant) Bandwidth() int64 {
+	value, _ := v.Attributes.Get("BANDWIDTH")
+	bandwidth, _ := strconv.ParseInt(value, 10, 64)
+	return bandwidth
+}
+
+// Resolution returns the RESOLUTION attribute, e.g. "1280x720".
+func (v *Variant) Resolution() string {
+	value, _ := v.Attributes.Get("RESOLUTION")
+	return value
+}
+
+// Rendition is #EXT-X-MEDIA, its uri (if any) is the URI attribute.
+type Rendition struct {
+	Attributes Attributes
+}
+
+// URI returns the playlist of the rendition, renditions muxed into the
+// variants have none.
+func (r *Rendition) URI() (string, bool) {
+	return r.Attributes.Get("URI")
+}
+
+func (r *Rendition) SetURI(uri string) {
+	r.Attributes.Set("URI", uri, true)
+}
+
+// Tag is a tag the package doesn't interpret, e.g. "#EXT-X-ALLOW-CACHE:YES"
+// is {Name: "EXT-X-ALLOW-CACHE", Value: "YES", HasValue: true}.
+type Tag struct {
+	Name     string
+	Value    string
+	HasValue bool
+}
+
+func parseTag(line string) Tag {
+	line = strings.TrimPrefix(line, "#")
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return Tag{Name: line[:i], Value: line[i+1:], HasValue: true}
+	}
+	return Tag{Name: line}
+}
+
+func (t Tag) String() string {
+	if t.HasValue {
+		return fmt.Sprintf("#%s:%s", t.Name, t.Value)
+	}
+	return "#" + t.Name
+}
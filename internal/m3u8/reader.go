@@ -0,0 +1,159 @@
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrNotPlaylist = errors.New("m3u8: missing #EXTM3U header")
+
+// Parse reads a media or master playlist. Comments (lines starting with "#"
+// but not "#EXT") are dropped.
+func Parse(r io.Reader) (*Playlist, error) {
+	p := &Playlist{}
+
+	// The segment or variant the following tags belong to, created lazily.
+	var segment *Segment
+	var variant *Variant
+	pendingTags := make([]Tag, 0)
+	sawSegment := false
+
+	currentSegment := func() *Segment {
+		if segment == nil {
+			segment = &Segment{}
+		}
+		return segment
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	header := false
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, ErrNotPlaylist
+			}
+			header = true
+			continue
+		}
+
+		fail := func(err error) (*Playlist, error) {
+			return nil, fmt.Errorf("m3u8: line %d: %w", lineNumber, err)
+		}
+
+		// A uri, closing the current segment or variant.
+		if !strings.HasPrefix(line, "#") {
+			if variant != nil {
+				variant.URI = line
+				p.Variants = append(p.Variants, variant)
+				variant = nil
+				continue
+			}
+			if segment == nil {
+				return fail(fmt.Errorf("uri %q without #EXTINF", line))
+			}
+			segment.URI = line
+			segment.Tags = append(segment.Tags, pendingTags...)
+			pendingTags = pendingTags[:0]
+			p.Segments = append(p.Segments, segment)
+			segment = nil
+			sawSegment = true
+			continue
+		}
+
+		// Comment.
+		if !strings.HasPrefix(line, "#EXT") {
+			continue
+		}
+
+		tag := parseTag(line)
+		var err error
+		switch tag.Name {
+		case "EXT-X-VERSION":
+			p.Version, err = strconv.Atoi(tag.Value)
+		case "EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case "EXT-X-TARGETDURATION":
+			p.TargetDuration, err = strconv.Atoi(tag.Value)
+		case "EXT-X-MEDIA-SEQUENCE":
+			p.MediaSequence, err = strconv.Atoi(tag.Value)
+		case "EXT-X-DISCONTINUITY-SEQUENCE":
+			p.DiscontinuitySequence, err = strconv.Atoi(tag.Value)
+		case "EXT-X-PLAYLIST-TYPE":
+			p.PlaylistType = tag.Value
+		case "EXT-X-ENDLIST":
+			p.EndList = true
+
+		case "EXTINF":
+			s := currentSegment()
+			duration, title := tag.Value, ""
+			if i := strings.IndexByte(tag.Value, ','); i >= 0 {
+				duration, title = tag.Value[:i], tag.Value[i+1:]
+			}
+			s.Title = title
+			s.Duration, err = strconv.ParseFloat(duration, 64)
+		case "EXT-X-BYTERANGE":
+			currentSegment().ByteRange, err = parseByteRange(tag.Value)
+		case "EXT-X-DISCONTINUITY":
+			currentSegment().Discontinuity = true
+		case "EXT-X-KEY":
+			currentSegment().Key, err = parseKey(tag.Value)
+		case "EXT-X-MAP":
+			currentSegment().Map, err = parseMap(tag.Value)
+		case "EXT-X-PROGRAM-DATE-TIME":
+			currentSegment().ProgramDateTime = tag.Value
+
+		case "EXT-X-STREAM-INF":
+			variant = &Variant{}
+			variant.Attributes, err = ParseAttributes(tag.Value)
+		case "EXT-X-I-FRAME-STREAM-INF":
+			v := &Variant{}
+			if v.Attributes, err = ParseAttributes(tag.Value); err == nil {
+				v.URI, _ = v.Attributes.Get("URI")
+				p.IFrameVariants = append(p.IFrameVariants, v)
+			}
+		case "EXT-X-MEDIA":
+			rendition := &Rendition{}
+			if rendition.Attributes, err = ParseAttributes(tag.Value); err == nil {
+				p.Renditions = append(p.Renditions, rendition)
+			}
+
+		default:
+			// Unknown tags stick to whatever they are in front of.
+			if sawSegment || segment != nil {
+				pendingTags = append(pendingTags, tag)
+			} else {
+				p.Tags = append(p.Tags, tag)
+			}
+		}
+		if err != nil {
+			return fail(fmt.Errorf("invalid #%s: %w", tag.Name, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !header {
+		return nil, ErrNotPlaylist
+	}
+	if variant != nil {
+		return nil, fmt.Errorf("m3u8: #EXT-X-STREAM-INF without uri")
+	}
+	if segment != nil {
+		return nil, fmt.Errorf("m3u8: #EXTINF without uri")
+	}
+	p.TrailingTags = append(p.TrailingTags, pendingTags...)
+
+	return p, nil
+}
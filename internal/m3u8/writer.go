@@ -0,0 +1,121 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// WriteTo writes the playlist. Tags are written in a fixed order, so the
+// output of a playlist written by this package (or by ffmpeg) is the same
+// as the playlist it was parsed from.
+func (p *Playlist) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(b, format, args...)
+		b.WriteByte('\n')
+	}
+
+	line("#EXTM3U")
+	if p.Version > 0 {
+		line("#EXT-X-VERSION:%d", p.Version)
+	}
+
+	if p.IsMaster() {
+		if p.IndependentSegments {
+			line("#EXT-X-INDEPENDENT-SEGMENTS")
+		}
+		for _, tag := range p.Tags {
+			line("%s", tag)
+		}
+		for _, rendition := range p.Renditions {
+			line("#EXT-X-MEDIA:%s", rendition.Attributes)
+		}
+		for _, variant := range p.Variants {
+			line("#EXT-X-STREAM-INF:%s", variant.Attributes)
+			line("%s", variant.URI)
+		}
+		for _, variant := range p.IFrameVariants {
+			attrs := append(Attributes{}, variant.Attributes...)
+			attrs.Set("URI", variant.URI, true)
+			line("#EXT-X-I-FRAME-STREAM-INF:%s", attrs)
+		}
+	} else {
+		line("#EXT-X-TARGETDURATION:%d", p.TargetDuration)
+		line("#EXT-X-MEDIA-SEQUENCE:%d", p.MediaSequence)
+		if p.DiscontinuitySequence > 0 {
+			line("#EXT-X-DISCONTINUITY-SEQUENCE:%d", p.DiscontinuitySequence)
+		}
+		if len(p.PlaylistType) > 0 {
+			line("#EXT-X-PLAYLIST-TYPE:%s", p.PlaylistType)
+		}
+		if p.IndependentSegments {
+			line("#EXT-X-INDEPENDENT-SEGMENTS")
+		}
+		for _, tag := range p.Tags {
+			line("%s", tag)
+		}
+		for _, segment := range p.Segments {
+			for _, tag := range segment.Tags {
+				line("%s", tag)
+			}
+			if segment.Discontinuity {
+				line("#EXT-X-DISCONTINUITY")
+			}
+			if segment.Key != nil {
+				line("#EXT-X-KEY:%s", segment.Key)
+			}
+			if segment.Map != nil {
+				line("#EXT-X-MAP:%s", segment.Map)
+			}
+			if len(segment.ProgramDateTime) > 0 {
+				line("#EXT-X-PROGRAM-DATE-TIME:%s", segment.ProgramDateTime)
+			}
+			line("#EXTINF:%s,%s", p.formatDuration(segment.Duration), segment.Title)
+			if segment.ByteRange != nil {
+				line("#EXT-X-BYTERANGE:%s", segment.ByteRange)
+			}
+			line("%s", segment.URI)
+		}
+		for _, tag := range p.TrailingTags {
+			line("%s", tag)
+		}
+		if p.EndList {
+			line("#EXT-X-ENDLIST")
+		}
+	}
+
+	err := b.Flush()
+	return cw.n, err
+}
+
+// String returns the playlist as written by WriteTo.
+func (p *Playlist) String() string {
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	return buf.String()
+}
+
+// Before version 3 durations have to be integers.
+func (p *Playlist) formatDuration(duration float64) string {
+	if p.Version > 0 && p.Version < 3 {
+		return strconv.FormatInt(int64(math.Round(duration)), 10)
+	}
+	return strconv.FormatFloat(duration, 'f', 6, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
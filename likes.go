@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// Likes or unlikes the video for the authenticated user. Doing it twice is
+// the same as doing it once, only an actual change moves the count.
+func (s *Server) setVideoLike(w http.ResponseWriter, r *http.Request, p httprouter.Params, like bool) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	if err := ensureVideoStats(s.DB, vid.ID); err != nil {
+		FailInternal(w, r, err, "Failed to update like.")
+		return
+	}
+
+	var stats *VideoStats
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// Likes of the same video are changed one at a time.
+		var err error
+		stats, err = lockVideoStats(tx, vid.ID)
+		if err != nil {
+			return err
+		}
+
+		existing := &video.VideoLikes{}
+		err = tx.Where(&video.VideoLikes{VideoID: vid.ID, UserID: usr.ID}).First(existing).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if !like {
+				return nil
+			}
+			err = tx.Create(&video.VideoLikes{VideoID: vid.ID, UserID: usr.ID, Like: true}).Error
+		case err != nil:
+			return err
+		case existing.Like == like:
+			return nil
+		default:
+			err = tx.Model(existing).Update("like", like).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		delta := int64(1)
+		if !like {
+			delta = -1
+		}
+		stats.Likes += delta
+		if err := incrementVideoStat(tx, vid.ID, "likes", delta); err != nil {
+			return err
+		}
+		if err := recordDailyStats(tx, &VideoDailyStats{VideoID: vid.ID, Day: time.Now(), Likes: delta}); err != nil {
+			return err
+		}
+		if !like {
+			return nil
+		}
+
+		// The owner is told by a task saved along with the like. A user is
+		// only ever notified of once per video, liking it again after an
+		// unlike says nothing new.
+		task, err := NewOwnerNotificationTask(fmt.Sprintf("like:%d:%d", vid.ID, usr.ID), vid.ID, usr.ID, video.Like)
+		if err != nil {
+			return err
+		}
+		return tx.Create(NewOutboxTask(task, 0)).Error
+	})
+	if err != nil {
+		FailInternal(w, r, err, "Failed to update like.")
+		return
+	}
+	if like {
+		s.Outbox.Notify()
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"liked":      like,
+		"like_count": stats.Likes,
+	})
+}
+
+func (s *Server) HandleLikeVideo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setVideoLike(w, r, p, true)
+}
+
+func (s *Server) HandleUnlikeVideo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setVideoLike(w, r, p, false)
+}
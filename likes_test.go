@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The owner is told about a like by a fan-out task saved along with it.
+func TestLikeVideoQueuesNotification(t *testing.T) {
+	db, mock := newMockDB(t)
+	cfg := DefaultConfig()
+	s := &Server{Config: cfg, DB: db, Outbox: NewOutboxDispatcher(db, &fakeQueue{}, nil, cfg.Outbox)}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username"}).AddRow(3, "bob"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `videos`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "key"}).AddRow(7, 9, "abc"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `video_id` FROM `video_stats`")).WillReturnRows(
+		sqlmock.NewRows([]string{"video_id"}).AddRow(7),
+	)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_stats`")).WillReturnRows(
+		sqlmock.NewRows([]string{"video_id", "likes"}).AddRow(7, 1),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_likes`")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_likes`")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `video_stats` SET `likes`=likes + ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `outbox_tasks`")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, TypeNotificationFanout,
+			[]byte(`{"key":"like:7:3","video_id":7,"actor_id":3,"type":0,"owner_only":true}`),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodPost, "/videos/7/like", nil)
+	r.Header.Set("X-Username", "bob")
+	w := httptest.NewRecorder()
+	s.HandleLikeVideo(w, r, httprouter.Params{{Key: "id", Value: "7"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("like returned %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		LikeCount int64 `json:"like_count"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.LikeCount != 2 {
+		t.Fatalf("like count is %d", body.LikeCount)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/redis/go-redis/v9"
+)
+
+// Deletes the lock only when it is still ours, it may have expired and been
+// taken by another replica in the meantime.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Takes the redis lock at key for at most ttl. Returns whether it was taken,
+// and when it was, the function to give it back with.
+func acquireLock(ctx context.Context, client *redis.Client, key string, ttl time.Duration) (func(), bool, error) {
+	token := uniuri.NewLen(32)
+	locked, err := client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !locked {
+		return nil, false, err
+	}
+	release := func() {
+		// Not ctx, it may be cancelled by now and the lock would be held
+		// until it expires.
+		releaseLockScript.Run(context.Background(), client, []string{key}, token)
+	}
+	return release, true, nil
+}
@@ -2,108 +2,96 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	db "github.com/help-me-someone/scalable-p2-db"
 	"github.com/hibiken/asynq"
-	"github.com/julienschmidt/httprouter"
-	"github.com/rs/cors"
 )
 
-const (
-	region = "sgp1"
-)
+// How long the requests in flight are given to finish when shutting down.
+const shutdownTimeout = 30 * time.Second
 
-var (
-	ALLOWED_ORIGIN string
-	DB_USERNAME    string
-	DB_PASSWORD    string
-	DB_IP          string
-	REDIS_IP       string
-	MODE           string
-)
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	flag.Parse()
 
-func loadEnvs() {
-	ALLOWED_ORIGIN = os.Getenv("ALLOWED_ORIGIN")
-	DB_USERNAME = os.Getenv("DB_USERNAME")
-	DB_PASSWORD = os.Getenv("DB_PASSWORD")
-	DB_IP = os.Getenv("DB_IP")
-	REDIS_IP = os.Getenv("REDIS_IP")
-	MODE = os.Getenv("MODE")
-}
+	// Retrieve the configuration, bail out early if anything is missing.
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-func main() {
-	// Retrieve all environment variables.
-	loadEnvs()
+	// Connect to the database, the queue and the object store.
+	server, err := NewServer(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Initalize the database.
-	toktik_db, _ := GetDatabaseConnection(DB_USERNAME, DB_PASSWORD, DB_IP)
-	db.InitTables(toktik_db)
-
-	redisArr := fmt.Sprintf("%s:6379", REDIS_IP)
-	taskQueueHandler := &TaskQueueHandler{
-		Connection: asynq.NewClient(asynq.RedisClientOpt{
-			Addr: redisArr,
-		}),
+	db.InitTables(server.DB)
+	if err := Migrate(server.DB); err != nil {
+		log.Fatalln("Failed to migrate the database:", err)
 	}
 
-	mux := httprouter.New()
-	mux.GET("/upload", GetUploadPresignedUrl)
-	mux.POST("/save", taskQueueHandler.TaskMiddleware(HandleVideoSave))
-	mux.POST("/comment", HandleVideoComment)
-
-	// The following endpoint uses database:
-	mux.GET("/users/:user/videos/:video", VideoHandler)
-
-	// Retrieve enough information for the frontend to be able to render.
-	mux.GET("/users/:user/videos/:video/info", HandleVideoInfo)
-	mux.GET("/watch/:user/:video/info", HandleVideoWatchInfo)
-	mux.GET("/video/feed/:amount/:page", VideoFeedHandler)
-	mux.GET("/video/rank/:rank", GetVideoByRank)
-	mux.GET("/users/:user/videos", GetUserVideos)
-
-	handler := cors.New(cors.Options{
-		AllowedOrigins:   []string{ALLOWED_ORIGIN},
-		AllowCredentials: true,
-		AllowedHeaders: []string{
-			"Hx-Current-Url",
-			"Hx-Request",
-			"Hx-Target",
-			"Hx-Boosted",
-			"Hx-Current-Url",
-			"Hx-Request",
-			"Hx-Trigger",
-			"Content-Type",
-			"X-Custom-Header",
-			"X-Username",
-			"*",
-		},
-		AllowedMethods: []string{
-			"POST",
-			"GET",
-			"PUT",
-			"OPTIONS",
-			"*",
-		},
-
-		// Enable Debugging for testing, consider disabling in production
-		Debug: (MODE == "DEBUG"),
-	}).Handler(mux)
-
-	log.Println("Server started successfully, listening on port 7000.")
-	log.Fatal(http.ListenAndServe(":7000", handler))
-}
+	// Everything below stops on SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-type TaskQueueHandler struct {
-	Connection *asynq.Client
-}
+	// Queue the tasks saved along with the videos.
+	go server.Outbox.Run(ctx)
+
+	// Process the backend's own tasks, e.g. notification fan-outs.
+	tasks := asynq.NewServer(asynq.RedisClientOpt{Addr: cfg.RedisAddr()}, asynq.Config{
+		Concurrency: cfg.Notifications.Concurrency,
+		Queues:      map[string]int{NOTIFICATIONS_QUEUE: 1},
+	})
+	if err := tasks.Start(server.TaskHandler()); err != nil {
+		log.Fatalln("Failed to start the task server:", err)
+	}
+
+	// Add the views counted in redis to the videos, and whatever is left
+	// once we are told to stop.
+	flushed := make(chan struct{})
+	go func() {
+		server.Views.Run(ctx)
+		close(flushed)
+	}()
 
-func (t *TaskQueueHandler) TaskMiddleware(next func(http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		ctx := context.WithValue(r.Context(), "queue_conn", t.Connection)
-		next(w, r.WithContext(ctx), p)
+	// Keep the feed rankings up to date.
+	go server.Rankings.Run(ctx)
+
+	// Push the notifications published by every replica to our sockets.
+	go server.Notifications.Run(ctx)
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: server.Routes(),
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Server started successfully, listening on port %d.", cfg.Server.Port)
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down.")
+
+	// Streams never finish on their own, they are cut once the time is up.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Println("Failed to shut down gracefully:", err)
+		httpServer.Close()
 	}
+	tasks.Shutdown()
+	<-flushed
 }
@@ -0,0 +1,308 @@
+// This file contains the schema of the tables owned by the backend. The
+// user and video tables live in scalable-p2-db.
+
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Upload session status.
+const (
+	UPLOAD_PENDING   = "pending"
+	UPLOAD_COMPLETED = "completed"
+	UPLOAD_SAVED     = "saved"
+	UPLOAD_ABORTED   = "aborted"
+)
+
+// UploadSession is created whenever an upload url is handed out, and is
+// what /save checks before accepting a video.
+type UploadSession struct {
+	// ID, CreatedAt, UpdatedAt, DeletedAt.
+	gorm.Model
+
+	// The video's key in s3.
+	Key string `gorm:"size:100;uniqueIndex" json:"key"`
+
+	// Owner ID.
+	UserID uint `gorm:"index" json:"user_id"`
+
+	// The owner's name, part of the key's path.
+	Username string `json:"username"`
+
+	// Set for multipart uploads.
+	UploadID string `json:"upload_id,omitempty"`
+
+	// One of the UPLOAD_* status.
+	Status string `gorm:"size:16" json:"status"`
+
+	// The session can't be used anymore after this.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Outbox task status.
+const (
+	OUTBOX_PENDING  = "pending"
+	OUTBOX_ENQUEUED = "enqueued"
+	OUTBOX_FAILED   = "failed"
+)
+
+// OutboxTask is an asynq task waiting to be queued. It is written in the
+// same transaction as the rows it is about, the dispatcher then makes sure
+// it reaches the queue.
+type OutboxTask struct {
+	// ID, CreatedAt, UpdatedAt, DeletedAt.
+	gorm.Model
+
+	// The asynq task.
+	Type    string `gorm:"size:64" json:"type"`
+	Payload []byte `json:"payload"`
+
+	// The video the task processes, if any.
+	VideoID uint `gorm:"index" json:"video_id"`
+
+	// One of the OUTBOX_* status.
+	Status string `gorm:"size:16;index:idx_outbox_due,priority:1" json:"status"`
+
+	// Failed attempts are retried with a backoff until MaxAttempts.
+	Attempts      int       `json:"attempts"`
+	LastError     string    `gorm:"type:text" json:"last_error,omitempty"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_due,priority:2" json:"next_attempt_at"`
+
+	// Set once the task is queued.
+	TaskID     string     `gorm:"size:64" json:"task_id,omitempty"`
+	EnqueuedAt *time.Time `json:"enqueued_at,omitempty"`
+}
+
+// Processing status of a video.
+const (
+	STATUS_UPLOADED   = "uploaded"
+	STATUS_QUEUED     = "queued"
+	STATUS_PROCESSING = "processing"
+	STATUS_READY      = "ready"
+	STATUS_FAILED     = "failed"
+)
+
+// VideoStatus tracks a video through the processing pipeline. The worker
+// only bumps video.Video's Status, this is reconciled from it and from the
+// queue.
+type VideoStatus struct {
+	// ID, CreatedAt, UpdatedAt, DeletedAt.
+	gorm.Model
+
+	// The video being processed.
+	VideoID uint `gorm:"uniqueIndex" json:"video_id"`
+
+	// One of the STATUS_* status.
+	Status string `gorm:"size:16" json:"status"`
+
+	// Why the processing failed.
+	Error string `gorm:"type:text" json:"error,omitempty"`
+
+	// The asynq task the video was queued as.
+	TaskID string `gorm:"size:64" json:"task_id,omitempty"`
+	Queue  string `gorm:"size:64" json:"queue,omitempty"`
+
+	// When each status was entered.
+	QueuedAt     *time.Time `json:"queued_at,omitempty"`
+	ProcessingAt *time.Time `json:"processing_at,omitempty"`
+	ReadyAt      *time.Time `json:"ready_at,omitempty"`
+	FailedAt     *time.Time `json:"failed_at,omitempty"`
+}
+
+// Comment is video.VideoComments with the columns the backend adds to its
+// table. Replies are only one level deep, ParentID is always a top level
+// comment.
+type Comment struct {
+	ID uint `gorm:"primarykey" json:"id"`
+
+	// VideoID foreign key.
+	VideoID uint `gorm:"index" json:"video_id"`
+
+	// UserID foreign key.
+	UserID uint `json:"user_id"`
+
+	// The comment body.
+	Comment string `json:"comment"`
+
+	// When the comment was created.
+	Date time.Time `json:"date"`
+
+	// The comment this replies to, nil for top level comments.
+	ParentID *uint `gorm:"index" json:"parent_id,omitempty"`
+
+	// Number of replies, kept up to date as they are made.
+	ReplyCount int `gorm:"not null;default:0" json:"reply_count"`
+
+	// Set when the author changed the comment, see CommentEdit.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+
+	// Hidden by the video's owner or an admin, only they and the author
+	// still see it.
+	Hidden bool `gorm:"not null;default:false" json:"hidden"`
+
+	// Soft delete, deleted comments are left out of every query.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	DeletedBy uint           `json:"-"`
+}
+
+func (Comment) TableName() string {
+	return "video_comments"
+}
+
+// CommentEdit keeps what a comment said before each edit.
+type CommentEdit struct {
+	ID uint `gorm:"primarykey" json:"id"`
+
+	// The edited comment.
+	CommentID uint `gorm:"index" json:"comment_id"`
+
+	// The comment body before the edit.
+	Comment string `json:"comment"`
+
+	// When the edit was made.
+	Date time.Time `json:"date"`
+}
+
+// VideoStats holds the counters of a video, kept up to date as things
+// happen so they never have to be counted.
+type VideoStats struct {
+	VideoID uint `gorm:"primarykey;autoIncrement:false" json:"video_id"`
+
+	// Number of users who like the video.
+	Likes int64 `gorm:"not null;default:0" json:"likes"`
+
+	// Number of comments and replies, deleted ones aside.
+	Comments int64 `gorm:"not null;default:0" json:"comments"`
+
+	// Playback, reported by the players. A play is a playback session, it
+	// is completed once it reached the end of the video.
+	Plays           int64   `gorm:"not null;default:0" json:"plays"`
+	Completions     int64   `gorm:"not null;default:0" json:"completions"`
+	WatchSeconds    float64 `gorm:"not null;default:0" json:"watch_seconds"`
+	BufferingEvents int64   `gorm:"not null;default:0" json:"buffering_events"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// VideoDailyStats is what happened to a video on a day (UTC), for the
+// creators' analytics. Counts are net, an unlike takes a like off the day
+// it happens. The columns have no default so every one of them is written
+// by recordDailyStats.
+type VideoDailyStats struct {
+	VideoID uint      `gorm:"primarykey;autoIncrement:false" json:"video_id"`
+	Day     time.Time `gorm:"primarykey;type:date" json:"day"`
+
+	Views        int64   `gorm:"not null" json:"views"`
+	Likes        int64   `gorm:"not null" json:"likes"`
+	Comments     int64   `gorm:"not null" json:"comments"`
+	Plays        int64   `gorm:"not null" json:"plays"`
+	Completions  int64   `gorm:"not null" json:"completions"`
+	WatchSeconds float64 `gorm:"not null" json:"watch_seconds"`
+}
+
+// VideoQualityStats is how long a video was watched in one of its
+// qualities, as reported by the players.
+type VideoQualityStats struct {
+	VideoID uint   `gorm:"primarykey;autoIncrement:false" json:"video_id"`
+	Quality string `gorm:"primarykey;size:16" json:"quality"`
+
+	WatchSeconds float64 `gorm:"not null;default:0" json:"watch_seconds"`
+}
+
+// ViewFlush is a batch of views added to the videos, so a flush which is
+// retried doesn't add them twice.
+type ViewFlush struct {
+	// The flush id and the first video of the batch.
+	Key string `gorm:"primarykey;size:64" json:"key"`
+
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// NotificationFanout tracks the delivery of a notification to every
+// participant of a video, so a retried task doesn't notify anyone twice.
+type NotificationFanout struct {
+	// ID, CreatedAt, UpdatedAt, DeletedAt.
+	gorm.Model
+
+	// What the participants are notified about, e.g. "comment:42".
+	Key string `gorm:"size:64;uniqueIndex" json:"key"`
+
+	// Recipients are notified by increasing id, everyone up to this one
+	// was.
+	LastUserID uint `json:"last_user_id"`
+
+	// Number of notifications created.
+	Delivered int64 `gorm:"not null;default:0" json:"delivered"`
+
+	// Set once everyone was notified.
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// NotificationPreference holds the kinds of notifications a user turned
+// off. Users without one get every notification.
+type NotificationPreference struct {
+	UserID uint `gorm:"primarykey;autoIncrement:false" json:"user_id"`
+
+	DisableComments bool `gorm:"not null;default:false" json:"disable_comments"`
+	DisableLikes    bool `gorm:"not null;default:false" json:"disable_likes"`
+
+	// Nobody is notified of follows yet, the setting is kept for when they
+	// are.
+	DisableFollows bool `gorm:"not null;default:false" json:"disable_follows"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// VideoMute stops the notifications about a video for a user.
+type VideoMute struct {
+	ID uint `gorm:"primarykey" json:"id"`
+
+	UserID  uint `gorm:"uniqueIndex:idx_video_mute,priority:1" json:"user_id"`
+	VideoID uint `gorm:"uniqueIndex:idx_video_mute,priority:2;index" json:"video_id"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Migrate creates or updates the tables owned by the backend.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&UploadSession{},
+		&OutboxTask{},
+		&VideoStatus{},
+		&Comment{},
+		&CommentEdit{},
+		&VideoStats{},
+		&NotificationFanout{},
+		&NotificationPreference{},
+		&VideoMute{},
+		&VideoDailyStats{},
+		&VideoQualityStats{},
+		&ViewFlush{},
+	)
+	if err != nil {
+		return err
+	}
+	return backfillVideoStats(db)
+}
+
+// Gives the videos made before the counters existed their likes and
+// comments, the rest was never counted. Videos which have counters are left
+// alone, so only the first run does anything.
+func backfillVideoStats(db *gorm.DB) error {
+	return db.Exec(`
+		INSERT INTO video_stats (video_id, likes, comments, updated_at)
+		SELECT
+			videos.id,
+			(SELECT COUNT(*) FROM video_likes
+				WHERE video_likes.video_id = videos.id AND video_likes.`+"`like`"+` = true AND video_likes.deleted_at IS NULL),
+			(SELECT COUNT(*) FROM video_comments
+				WHERE video_comments.video_id = videos.id AND video_comments.deleted_at IS NULL),
+			?
+		FROM videos
+		WHERE NOT EXISTS (SELECT 1 FROM video_stats WHERE video_stats.video_id = videos.id)`,
+		time.Now(),
+	).Error
+}
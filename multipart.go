@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/dchest/uniuri"
+)
+
+// S3 only accepts parts numbered from 1 to 10000.
+const (
+	minPartNumber = 1
+	maxPartNumber = 10000
+)
+
+// Errors of the stores, the parts ones are the client's fault.
+var (
+	ErrUploadNotFound   = errors.New("multipart upload not found")
+	ErrInvalidPart      = errors.New("part is missing or does not match its etag")
+	ErrInvalidPartOrder = errors.New("parts are not listed in ascending order")
+	ErrPartTooSmall     = errors.New("part is smaller than 5 MiB")
+)
+
+// UploadedPart is a part of a multipart upload which reached the store.
+type UploadedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+// MultipartStorage is implemented by stores which accept an object in
+// several parts. Clients upload the parts one by one, so an interrupted
+// upload can resume from the last part which made it.
+type MultipartStorage interface {
+	// CreateMultipartUpload starts an upload and returns its id.
+	CreateMultipartUpload(ctx context.Context, key string) (string, error)
+
+	// PresignUploadPart returns a url accepting a PUT of the part.
+	PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32) (string, error)
+
+	// ListParts returns the parts uploaded so far, ordered by number.
+	ListParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error)
+
+	// CompleteMultipartUpload assembles the parts into the object.
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error
+
+	// AbortMultipartUpload drops the upload and every uploaded part.
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+/*----------------------
+|  S3 / Spaces
+-----------------------*/
+
+// Errors S3 returns when the parts listed by the client don't add up.
+var s3PartErrors = map[string]error{
+	"InvalidPart":      ErrInvalidPart,
+	"InvalidPartOrder": ErrInvalidPartOrder,
+	"EntityTooSmall":   ErrPartTooSmall,
+}
+
+func s3UploadError(err error) error {
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchUpload) {
+		return ErrUploadNotFound
+	}
+	var s3Err smithy.APIError
+	if errors.As(err, &s3Err) {
+		if partErr, ok := s3PartErrors[s3Err.ErrorCode()]; ok {
+			return fmt.Errorf("%w: %v", partErr, err)
+		}
+	}
+	return err
+}
+
+func (s *S3Storage) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	output, err := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.UploadId), nil
+}
+
+func (s *S3Storage) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32) (string, error) {
+	req, err := s.presign.PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: partNumber,
+	}, s3.WithPresignExpires(s.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3Storage) ListParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error) {
+	parts := make([]UploadedPart, 0)
+	paginator := s3.NewListPartsPaginator(s.Client, &s3.ListPartsInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, s3UploadError(err)
+		}
+		for _, part := range page.Parts {
+			parts = append(parts, UploadedPart{
+				PartNumber: part.PartNumber,
+				ETag:       aws.ToString(part.ETag),
+				Size:       part.Size,
+			})
+		}
+	}
+	return parts, nil
+}
+
+func (s *S3Storage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: part.PartNumber,
+		})
+	}
+	_, err := s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	return s3UploadError(err)
+}
+
+func (s *S3Storage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return s3UploadError(err)
+}
+
+/*----------------------
+|  Local filesystem
+-----------------------*/
+
+// The parts of an upload are kept as ".multipart/<upload id>/<part number>"
+// next to the objects, along with a "key" file holding the target key. The
+// presigned part urls are regular presigned PUTs of those files.
+const localMultipartDir = ".multipart"
+
+func (l *LocalStorage) uploadDir(key, uploadID string) (string, error) {
+	if len(uploadID) == 0 || strings.ContainsAny(uploadID, `/\.`) {
+		return "", ErrUploadNotFound
+	}
+	dir := filepath.Join(l.Root, localMultipartDir, uploadID)
+	target, err := os.ReadFile(filepath.Join(dir, "key"))
+	if err != nil || string(target) != key {
+		return "", ErrUploadNotFound
+	}
+	return dir, nil
+}
+
+func (l *LocalStorage) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	uploadID := uniuri.NewLen(32)
+	dir := filepath.Join(l.Root, localMultipartDir, uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key"), []byte(key), 0o644); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (l *LocalStorage) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32) (string, error) {
+	if _, err := l.uploadDir(key, uploadID); err != nil {
+		return "", err
+	}
+	return l.sign(http.MethodPut, fmt.Sprintf("%s/%s/%d", localMultipartDir, uploadID, partNumber))
+}
+
+func (l *LocalStorage) ListParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error) {
+	dir, err := l.uploadDir(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]UploadedPart, 0)
+	for _, entry := range entries {
+		number, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		etag, size, err := fileETag(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, UploadedPart{
+			PartNumber: int32(number),
+			ETag:       etag,
+			Size:       size,
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (l *LocalStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) error {
+	dir, err := l.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	// Assemble next to the target, so readers never see half an object.
+	tmp := fmt.Sprintf("%s.%d.tmp", target, time.Now().UnixNano())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// Same rules as S3, so clients don't behave differently offline.
+	previous := int32(0)
+	for _, part := range parts {
+		if part.PartNumber <= previous {
+			out.Close()
+			return ErrInvalidPartOrder
+		}
+		previous = part.PartNumber
+
+		partPath := filepath.Join(dir, strconv.Itoa(int(part.PartNumber)))
+		etag, _, err := fileETag(partPath)
+		if err != nil || etag != part.ETag {
+			out.Close()
+			return fmt.Errorf("%w: part %d", ErrInvalidPart, part.PartNumber)
+		}
+		in, err := os.Open(partPath)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (l *LocalStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	dir, err := l.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Same format as the etags S3 returns for single part uploads.
+func fileETag(p string) (string, int64, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%q", hex.EncodeToString(hash.Sum(nil))), size, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+// Starts a local multipart upload of key and uploads the parts through
+// their presigned urls.
+func uploadLocalParts(t *testing.T, key string, parts ...string) (*LocalStorage, string, []UploadedPart) {
+	t.Helper()
+
+	local, _ := newLocalStorageServer(t)
+	ctx := context.Background()
+	uploadID, err := local.CreateMultipartUpload(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := make([]UploadedPart, 0, len(parts))
+	for i, content := range parts {
+		number := int32(i + 1)
+		url, err := local.PresignUploadPart(ctx, key, uploadID, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := doStorageRequest(t, http.MethodPut, url, strings.NewReader(content))
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("part %d returned %d", number, res.StatusCode)
+		}
+		uploaded = append(uploaded, UploadedPart{PartNumber: number, ETag: res.Header.Get("ETag")})
+	}
+	return local, uploadID, uploaded
+}
+
+func TestLocalMultipartUpload(t *testing.T) {
+	key := "users/bob/videos/abc/vid"
+	local, uploadID, parts := uploadLocalParts(t, key, "first ", "second ", "third")
+	ctx := context.Background()
+
+	listed, err := local.ListParts(ctx, key, uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0].ETag != parts[0].ETag || listed[2].Size != int64(len("third")) {
+		t.Fatalf("listed %+v", listed)
+	}
+
+	if err := local.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(local.Root, filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "first second third" {
+		t.Fatalf("assembled %q", content)
+	}
+
+	// The parts are gone with the upload.
+	if _, err := local.ListParts(ctx, key, uploadID); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("listing a completed upload returned %v", err)
+	}
+}
+
+func TestLocalMultipartCompleteRejectsBadParts(t *testing.T) {
+	key := "users/bob/videos/abc/vid"
+
+	cases := []struct {
+		name  string
+		parts func([]UploadedPart) []UploadedPart
+	}{
+		{"wrong etag", func(parts []UploadedPart) []UploadedPart {
+			parts[1].ETag = `"00000000000000000000000000000000"`
+			return parts
+		}},
+		{"missing part", func(parts []UploadedPart) []UploadedPart {
+			return append(parts, UploadedPart{PartNumber: 4, ETag: parts[0].ETag})
+		}},
+		{"out of order", func(parts []UploadedPart) []UploadedPart {
+			parts[0], parts[1] = parts[1], parts[0]
+			return parts
+		}},
+		{"repeated part", func(parts []UploadedPart) []UploadedPart {
+			return append(parts, parts[2])
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			local, uploadID, parts := uploadLocalParts(t, key, "first ", "second ", "third")
+
+			err := local.CompleteMultipartUpload(context.Background(), key, uploadID, c.parts(append([]UploadedPart{}, parts...)))
+			apiErr := &APIError{}
+			if !errors.As(multipartError(err, "Failed to complete upload."), &apiErr) || apiErr.Code != CODE_INVALID_REQUEST {
+				t.Fatalf("got %v, want an invalid request", err)
+			}
+
+			// Nothing was assembled and the upload can still be completed.
+			if _, err := os.Stat(filepath.Join(local.Root, filepath.FromSlash(key))); !os.IsNotExist(err) {
+				t.Fatalf("object was written: %v", err)
+			}
+			if err := local.CompleteMultipartUpload(context.Background(), key, uploadID, parts); err != nil {
+				t.Fatalf("retry failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestMultipartError(t *testing.T) {
+	cases := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{ErrUploadNotFound, CODE_UPLOAD_NOT_FOUND},
+		{ErrInvalidPartOrder, CODE_INVALID_REQUEST},
+		{fmt.Errorf("%w: part 2", ErrInvalidPart), CODE_INVALID_REQUEST},
+		{ErrPartTooSmall, CODE_INVALID_REQUEST},
+		{errors.New("disk full"), CODE_INTERNAL},
+	}
+	for _, c := range cases {
+		apiErr := &APIError{}
+		if !errors.As(multipartError(c.err, "Failed."), &apiErr) || apiErr.Code != c.code {
+			t.Errorf("multipartError(%v) = %v, want %s", c.err, apiErr, c.code)
+		}
+	}
+}
+
+func TestS3UploadError(t *testing.T) {
+	cases := map[string]error{
+		"InvalidPart":      ErrInvalidPart,
+		"InvalidPartOrder": ErrInvalidPartOrder,
+		"EntityTooSmall":   ErrPartTooSmall,
+	}
+	for code, want := range cases {
+		if err := s3UploadError(&smithy.GenericAPIError{Code: code, Message: "nope"}); !errors.Is(err, want) {
+			t.Errorf("%s mapped to %v", code, err)
+		}
+	}
+
+	other := &smithy.GenericAPIError{Code: "InternalError"}
+	if err := s3UploadError(other); err != other {
+		t.Errorf("InternalError mapped to %v", err)
+	}
+}
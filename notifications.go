@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// Notification groups returned per page, unless asked otherwise.
+const (
+	defaultNotificationPage = 20
+	maxNotificationPage     = 50
+)
+
+// Actors named in a group's message, the rest are counted.
+const namedActors = 2
+
+// Pushes a saved notification to the recipient's sockets on every replica.
+// The inbox is the source of truth, a notification which couldn't be pushed
+// is replayed when the socket reconnects.
+func (s *Server) publishNotification(notification *video.VideoNotifications, actor string) {
+	err := s.Notifications.Publish(context.Background(), notification.UserID, NotificationEvent{
+		ID:      notification.ID,
+		Type:    notification.Type,
+		VideoID: notification.VideoID,
+		ActorID: notification.ActorID,
+		Actor:   actor,
+		Date:    notification.Date,
+	})
+	if err != nil {
+		log.Println("Failed to publish notification:", err)
+	}
+}
+
+/*----------------------
+|  Inbox
+-----------------------*/
+
+// NotificationGroup is every notification of the same kind about the same
+// video, e.g. "alice, bob and 3 others commented on your video".
+type NotificationGroup struct {
+	// The latest notification of the group, marking it read marks the
+	// whole group.
+	ID uint `json:"id"`
+
+	Type    video.NotificationType `json:"type"`
+	Read    bool                   `json:"read"`
+	Count   int64                  `json:"count"`
+	Date    time.Time              `json:"date"`
+	Message string                 `json:"message"`
+
+	// The latest actors, and how many there are in total.
+	Actors     []string `json:"actors"`
+	ActorCount int64    `json:"actor_count"`
+
+	Video NotificationVideo `json:"video"`
+}
+
+// NotificationVideo is enough of the video to link to it.
+type NotificationVideo struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Username string `json:"username"`
+	UserID   uint   `json:"-"`
+}
+
+// Where the previous page of groups ended.
+type notificationCursor struct {
+	Date time.Time `json:"d"`
+	ID   uint      `json:"i"`
+}
+
+// Groups the notifications of the user, latest first.
+func notificationGroups(db *gorm.DB, userID uint, cursor *notificationCursor, limit int) ([]NotificationGroup, error) {
+	query := db.Model(&video.VideoNotifications{}).
+		Select("video_id, type, `read`, COUNT(*) AS count, COUNT(DISTINCT actor_id) AS actor_count, MAX(date) AS latest_date, MAX(id) AS latest_id").
+		Where("user_id = ?", userID).
+		Group("video_id, type, `read`")
+	if cursor != nil {
+		query = query.Having("MAX(date) < ? OR (MAX(date) = ? AND MAX(id) < ?)", cursor.Date, cursor.Date, cursor.ID)
+	}
+
+	rows := make([]struct {
+		VideoID    uint
+		Type       video.NotificationType
+		Read       bool
+		Count      int64
+		ActorCount int64
+		LatestDate time.Time
+		LatestID   uint
+	}, 0)
+	err := query.Order("latest_date DESC, latest_id DESC").Limit(limit).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]NotificationGroup, 0, len(rows))
+	for _, row := range rows {
+		groups = append(groups, NotificationGroup{
+			ID:         row.LatestID,
+			Type:       row.Type,
+			Read:       row.Read,
+			Count:      row.Count,
+			Date:       row.LatestDate,
+			ActorCount: row.ActorCount,
+			Video:      NotificationVideo{ID: row.VideoID},
+		})
+	}
+	return groups, nil
+}
+
+// Fills in the actors and the video of the group, then its message.
+func describeNotificationGroup(db *gorm.DB, userID uint, group *NotificationGroup) error {
+	err := db.Model(&video.VideoNotifications{}).
+		Select("users.username").
+		Joins("JOIN users ON users.id = video_notifications.actor_id").
+		Where("video_notifications.user_id = ? AND video_notifications.video_id = ? AND video_notifications.type = ? AND video_notifications.`read` = ?", userID, group.Video.ID, group.Type, group.Read).
+		Group("users.username").
+		Order("MAX(video_notifications.date) DESC").
+		Limit(namedActors).
+		Pluck("users.username", &group.Actors).Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Table("videos").
+		Select("videos.id, videos.name, videos.key, videos.user_id, users.username").
+		Joins("JOIN users ON users.id = videos.user_id").
+		Where("videos.id = ?", group.Video.ID).
+		Scan(&group.Video).Error
+	if err != nil {
+		return err
+	}
+
+	group.Message = notificationMessage(group, group.Video.UserID == userID)
+	return nil
+}
+
+// e.g. "alice, bob and 3 others commented on your video "Cats"".
+func notificationMessage(group *NotificationGroup, owner bool) string {
+	actors := strings.Join(group.Actors, ", ")
+	others := group.ActorCount - int64(len(group.Actors))
+	switch {
+	case others == 1:
+		actors += " and 1 other"
+	case others > 1:
+		actors += fmt.Sprintf(" and %d others", others)
+	case len(group.Actors) > 1:
+		last := strings.LastIndex(actors, ", ")
+		actors = actors[:last] + " and " + actors[last+2:]
+	}
+	if len(group.Actors) == 0 {
+		actors = "Someone"
+	}
+
+	verb := "commented on"
+	if group.Type == video.Like {
+		verb = "liked"
+	}
+
+	target := fmt.Sprintf("%q", group.Video.Name)
+	if owner {
+		target = "your video " + target
+	}
+	return fmt.Sprintf("%s %s %s", actors, verb, target)
+}
+
+func unreadNotificationCount(db *gorm.DB, userID uint) (int64, error) {
+	var unread int64
+	err := db.Model(&video.VideoNotifications{}).
+		Where("user_id = ? AND `read` = ?", userID, false).
+		Count(&unread).Error
+	return unread, err
+}
+
+// Lists the notifications of the authenticated user, grouped by video and
+// kind, latest first.
+func (s *Server) HandleListNotifications(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := pageLimit(r, defaultNotificationPage, maxNotificationPage)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	var cursor *notificationCursor
+	if value := r.URL.Query().Get("cursor"); len(value) > 0 {
+		cursor = &notificationCursor{}
+		if err := decodeCursor(value, cursor); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+	}
+
+	// One more than asked, to know whether there is a next page.
+	groups, err := notificationGroups(s.DB, usr.ID, cursor, limit+1)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get notifications.")
+		return
+	}
+
+	next := ""
+	if len(groups) > limit {
+		groups = groups[:limit]
+		last := groups[limit-1]
+		next = encodeCursor(notificationCursor{Date: last.Date, ID: last.ID})
+	}
+
+	for i := range groups {
+		if err := describeNotificationGroup(s.DB, usr.ID, &groups[i]); err != nil {
+			FailInternal(w, r, err, "Failed to get notifications.")
+			return
+		}
+	}
+
+	unread, err := unreadNotificationCount(s.DB, usr.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to count notifications.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"notifications": groups,
+		"unread":        unread,
+		"next_cursor":   next,
+	})
+}
+
+// Returns how many notifications the authenticated user hasn't read, for
+// the badge.
+func (s *Server) HandleUnreadNotifications(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	unread, err := unreadNotificationCount(s.DB, usr.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to count notifications.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"unread": unread,
+	})
+}
+
+// Marks a notification read, along with the rest of its group. The id
+// "all" marks every notification read.
+func (s *Server) HandleReadNotification(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	unread := s.DB.Model(&video.VideoNotifications{}).Where("user_id = ? AND `read` = ?", usr.ID, false)
+
+	if p.ByName("id") != "all" {
+		id, err := strconv.ParseUint(p.ByName("id"), 10, 64)
+		if err != nil {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid notification id.")
+			return
+		}
+
+		notification := &video.VideoNotifications{}
+		err = s.DB.Where("id = ? AND user_id = ?", id, usr.ID).First(notification).Error
+		if err != nil {
+			WriteError(w, r, notificationLookupError(err))
+			return
+		}
+		unread = unread.Where("video_id = ? AND type = ?", notification.VideoID, notification.Type)
+	}
+
+	result := unread.Update("read", true)
+	if result.Error != nil {
+		FailInternal(w, r, result.Error, "Failed to mark notifications read.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Notifications marked read.",
+		"marked":  result.RowsAffected,
+	})
+}
+
+func notificationLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return NewAPIError(CODE_NOT_FOUND, "Notification not found.")
+	}
+	return Internal(err, "Failed to get notification.")
+}
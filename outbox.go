@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Longest a failed task waits before it is tried again.
+const maxOutboxBackoff = 5 * time.Minute
+
+// How long finished tasks are kept in the queue, so their outcome can be
+// looked up by the status endpoint.
+const taskRetention = 24 * time.Hour
+
+// NewOutboxTask wraps the task so it can be saved along with the rows it is
+// about. It is queued by the OutboxDispatcher once the transaction commits.
+func NewOutboxTask(task *asynq.Task, videoID uint) *OutboxTask {
+	return &OutboxTask{
+		Type:          task.Type(),
+		Payload:       task.Payload(),
+		VideoID:       videoID,
+		Status:        OUTBOX_PENDING,
+		NextAttemptAt: time.Now(),
+	}
+}
+
+// The asynq task ID of an outbox task. asynq refuses a second task with the
+// same ID, so a task which got queued but not marked isn't queued twice.
+func outboxTaskID(id uint) string {
+	return fmt.Sprintf("outbox-%d", id)
+}
+
+// The queue of each task type, "default" for the others.
+var taskQueues = map[string]string{
+	TypeNotificationFanout: NOTIFICATIONS_QUEUE,
+}
+
+func outboxQueue(taskType string) string {
+	if queue, ok := taskQueues[taskType]; ok {
+		return queue
+	}
+	return "default"
+}
+
+// OutboxDispatcher moves the pending outbox tasks to the queue. Several
+// replicas can run one, the rows are locked while they are dispatched.
+type OutboxDispatcher struct {
+	DB    *gorm.DB
+	Queue TaskQueue
+
+	// How often the outbox is checked when nobody calls Notify.
+	Interval time.Duration
+
+	// Tasks dispatched per transaction.
+	BatchSize int
+
+	// A task is given up on after this many failed attempts.
+	MaxAttempts int
+
+	// Where the status changes of the videos are published, may be nil.
+	Events *VideoEvents
+
+	wake chan struct{}
+}
+
+func NewOutboxDispatcher(db *gorm.DB, queue TaskQueue, events *VideoEvents, cfg OutboxConfig) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		DB:          db,
+		Queue:       queue,
+		Events:      events,
+		Interval:    time.Duration(cfg.Interval),
+		BatchSize:   cfg.BatchSize,
+		MaxAttempts: cfg.MaxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the dispatcher up, so a new task doesn't wait for the next
+// tick. It never blocks.
+func (d *OutboxDispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches tasks until the context is cancelled.
+func (d *OutboxDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there are full batches.
+		for {
+			count, err := d.dispatch(ctx)
+			if err != nil {
+				log.Println("Failed to dispatch outbox:", err)
+				break
+			}
+			if count < d.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Queues a batch of due tasks, returns how many were tried.
+func (d *OutboxDispatcher) dispatch(ctx context.Context) (int, error) {
+	tasks := make([]OutboxTask, 0)
+	changed := make([]*VideoStatus, 0)
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		// Rows locked by another replica are left to it.
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", OUTBOX_PENDING, time.Now()).
+			Order("id").
+			Limit(d.BatchSize).
+			Find(&tasks).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range tasks {
+			status, err := d.enqueue(tx, &tasks[i])
+			if err != nil {
+				return err
+			}
+			if status != nil {
+				changed = append(changed, status)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return len(tasks), err
+	}
+
+	// Only announced once they are committed.
+	for _, status := range changed {
+		d.Events.PublishStatus(ctx, d.DB, status)
+	}
+	return len(tasks), nil
+}
+
+// Queues a single task and records how it went. Only database errors are
+// returned, a queue failure is saved on the task and retried later. The
+// video's status is returned when it changed.
+func (d *OutboxDispatcher) enqueue(tx *gorm.DB, task *OutboxTask) (*VideoStatus, error) {
+	taskID := outboxTaskID(task.ID)
+	queue := outboxQueue(task.Type)
+	info, err := d.Queue.Enqueue(
+		asynq.NewTask(task.Type, task.Payload),
+		asynq.TaskID(taskID),
+		asynq.Queue(queue),
+		asynq.Retention(taskRetention),
+	)
+
+	// Already queued by an attempt which failed to be marked.
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		err = nil
+	} else if err == nil {
+		queue = info.Queue
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	if err == nil {
+		updates["status"] = OUTBOX_ENQUEUED
+		updates["task_id"] = taskID
+		updates["enqueued_at"] = now
+	} else {
+		attempts := task.Attempts + 1
+		log.Printf("Failed to enqueue outbox task %d (attempt %d): %v", task.ID, attempts, err)
+
+		updates["attempts"] = attempts
+		updates["last_error"] = err.Error()
+		if attempts >= d.MaxAttempts {
+			updates["status"] = OUTBOX_FAILED
+		} else {
+			updates["next_attempt_at"] = now.Add(outboxBackoff(attempts))
+		}
+	}
+	if err := tx.Model(task).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	// Let the video's status follow.
+	if task.VideoID == 0 {
+		return nil, nil
+	}
+	switch updates["status"] {
+	case OUTBOX_ENQUEUED:
+		return transitionVideoStatus(tx, task.VideoID, STATUS_QUEUED, "", func(status *VideoStatus) {
+			status.TaskID = taskID
+			status.Queue = queue
+		})
+	case OUTBOX_FAILED:
+		return transitionVideoStatus(tx, task.VideoID, STATUS_FAILED, "failed to queue the video: "+err.Error(), nil)
+	}
+	return nil, nil
+}
+
+// Exponential backoff starting at a second.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 9 {
+		return maxOutboxBackoff
+	}
+	backoff := time.Duration(1<<attempts) * time.Second / 2
+	if backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
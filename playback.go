@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Limits of a batch of playback events.
+const (
+	maxPlaybackEvents    = 100
+	maxPlaybackSessionID = 64
+)
+
+// Length of the session ids handed to the players.
+const playbackSessionLength = 32
+
+// Progress further apart than this is a seek, not something watched.
+const maxHeartbeatGap = 60.0
+
+// How long a playback session is remembered after its last batch.
+const playbackSessionTTL = time.Hour
+
+// PlaybackEvent is a heartbeat sent by the player.
+type PlaybackEvent struct {
+	// Where the player is in the video, in seconds.
+	Position float64 `json:"position"`
+
+	// Whether the player was waiting for data.
+	Buffering bool `json:"buffering"`
+
+	// The variant being played, e.g. "720p". What was watched since the
+	// previous event is counted towards it.
+	Quality string `json:"quality"`
+
+	// Set once the end of the video was reached.
+	Completed bool `json:"completed"`
+}
+
+// Where the player of a session was. Sessions are kept in redis so a batch
+// carries on from the previous one, whichever replica got it. Only the
+// sessions we handed out exist, players can't make up their own.
+func playbackSessionKey(session string) string {
+	return fmt.Sprintf("playback:%s", session)
+}
+
+// Swaps the time of the session's previous batch (in milliseconds) for now
+// and returns it, or -1 when the session is gone. Concurrent batches of a
+// session can't both claim the same time.
+var claimPlaybackHeartbeat = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local previous = tonumber(redis.call("HGET", KEYS[1], "heartbeat")) or 0
+redis.call("HSET", KEYS[1], "heartbeat", ARGV[1])
+return previous
+`)
+
+// Gives back what a batch claimed when its counters couldn't be saved, so
+// the player can send it again. The heartbeat and the position are only
+// put back while no later batch moved them on.
+var releasePlaybackClaims = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "heartbeat") == ARGV[1] then
+	redis.call("HSET", KEYS[1], "heartbeat", ARGV[2])
+	if ARGV[3] == "" then
+		redis.call("HDEL", KEYS[1], "position")
+	else
+		redis.call("HSET", KEYS[1], "position", ARGV[3])
+	end
+end
+if ARGV[4] == "1" then
+	redis.call("HDEL", KEYS[1], "played")
+end
+if ARGV[5] == "1" then
+	redis.call("HDEL", KEYS[1], "completed")
+end
+return 0
+`)
+
+// What a batch took from its session: the time since the previous batch,
+// and the play and the completion when it was the first to see them.
+type playbackClaim struct {
+	Key       string
+	Heartbeat int64
+	Previous  int64
+	Position  string
+	Played    bool
+	Completed bool
+}
+
+func (c *playbackClaim) Release(ctx context.Context, client *redis.Client) error {
+	flag := func(claimed bool) string {
+		if claimed {
+			return "1"
+		}
+		return "0"
+	}
+	return releasePlaybackClaims.Run(ctx, client, []string{c.Key},
+		c.Heartbeat, c.Previous, c.Position, flag(c.Played), flag(c.Completed)).Err()
+}
+
+// What a batch adds to the counters of the video.
+type playbackTotals struct {
+	WatchSeconds float64
+	Plays        int64
+	Completions  int64
+	Buffering    int64
+
+	// Watch seconds by quality, events without one aren't in there.
+	Qualities map[string]float64
+}
+
+// Adds up a batch of events played from position, which is negative until
+// the session's first heartbeat. No more than elapsed seconds can have been
+// watched since the previous batch, whatever the positions say. Returns the
+// last position and whether the end was reached.
+func addUpPlayback(position, elapsed float64, events []PlaybackEvent) (*playbackTotals, float64, bool) {
+	totals := &playbackTotals{Qualities: make(map[string]float64)}
+	completed := false
+	for _, event := range events {
+		delta := event.Position - position
+		if position >= 0 && delta > 0 && delta <= maxHeartbeatGap && !event.Buffering {
+			totals.WatchSeconds += delta
+			if len(event.Quality) > 0 {
+				totals.Qualities[event.Quality] += delta
+			}
+		}
+		position = event.Position
+
+		if event.Buffering {
+			totals.Buffering++
+		}
+		completed = completed || event.Completed
+	}
+	if totals.WatchSeconds > elapsed {
+		// Every quality gets its share of what is left.
+		ratio := math.Max(elapsed, 0) / totals.WatchSeconds
+		for quality := range totals.Qualities {
+			totals.Qualities[quality] *= ratio
+		}
+		totals.WatchSeconds = math.Max(elapsed, 0)
+	}
+	return totals, position, completed
+}
+
+// Adds up a batch of events, given where the session was. A session is a
+// play the first time it is seen, and a completion the first time it
+// reaches the end. What the batch claimed has to be released if its totals
+// aren't saved.
+func (s *Server) playbackTotals(ctx context.Context, session string, videoID uint, events []PlaybackEvent) (*playbackTotals, *playbackClaim, error) {
+	key := playbackSessionKey(session)
+	id := strconv.FormatUint(uint64(videoID), 10)
+
+	state, err := s.Redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, nil, Internal(err, "Failed to record playback.")
+	}
+	if len(state) == 0 {
+		return nil, nil, NewAPIError(CODE_PLAYBACK_EXPIRED, "Playback session expired, start a new one.")
+	}
+	if state["video"] != id {
+		return nil, nil, NewAPIError(CODE_CONFLICT, "Playback session belongs to another video.")
+	}
+
+	now := time.Now()
+	claim := &playbackClaim{Key: key, Heartbeat: now.UnixMilli(), Position: state["position"]}
+	claim.Previous, err = claimPlaybackHeartbeat.Run(ctx, s.Redis, []string{key}, claim.Heartbeat).Int64()
+	if err != nil {
+		return nil, nil, Internal(err, "Failed to record playback.")
+	}
+	if claim.Previous < 0 {
+		return nil, nil, NewAPIError(CODE_PLAYBACK_EXPIRED, "Playback session expired, start a new one.")
+	}
+	elapsed := 0.0
+	if claim.Previous > 0 {
+		elapsed = float64(claim.Heartbeat-claim.Previous) / 1000
+	}
+
+	position := -1.0
+	if len(claim.Position) > 0 {
+		position, _ = strconv.ParseFloat(claim.Position, 64)
+	}
+	totals, position, completed := addUpPlayback(position, elapsed, events)
+
+	// Anything going wrong from here gives back what was claimed so far.
+	fail := func(err error) (*playbackTotals, *playbackClaim, error) {
+		if err := claim.Release(context.Background(), s.Redis); err != nil {
+			log.Println("Failed to release playback claims:", err)
+		}
+		return nil, nil, Internal(err, "Failed to record playback.")
+	}
+
+	claim.Played, err = s.Redis.HSetNX(ctx, key, "played", 1).Result()
+	if err != nil {
+		return fail(err)
+	}
+	if claim.Played {
+		totals.Plays = 1
+	}
+
+	if completed {
+		claim.Completed, err = s.Redis.HSetNX(ctx, key, "completed", 1).Result()
+		if err != nil {
+			return fail(err)
+		}
+		if claim.Completed {
+			totals.Completions = 1
+		}
+	}
+
+	_, err = s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "position", strconv.FormatFloat(position, 'f', -1, 64))
+		pipe.Expire(ctx, key, playbackSessionTTL)
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return totals, claim, nil
+}
+
+// Starts a playback of the video, the player sends its heartbeats with the
+// session it is given.
+func (s *Server) HandleCreatePlaybackSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	session := uniuri.NewLen(playbackSessionLength)
+	key := playbackSessionKey(session)
+	_, err := s.Redis.TxPipelined(r.Context(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.Context(), key,
+			"video", strconv.FormatUint(uint64(vid.ID), 10),
+			"heartbeat", time.Now().UnixMilli(),
+		)
+		pipe.Expire(r.Context(), key, playbackSessionTTL)
+		return nil
+	})
+	if err != nil {
+		FailInternal(w, r, err, "Failed to start playback.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"session":    session,
+		"expires_in": int(playbackSessionTTL.Seconds()),
+	})
+}
+
+// Takes the heartbeats a player batched up while the video played:
+//
+//	{"session": "...", "events": [{"position": 12.5, "buffering": false, "quality": "720p", "completed": false}]}
+//
+// The session comes from HandleCreatePlaybackSession, once per playback.
+func (s *Server) HandlePlaybackEvents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	payload := struct {
+		Session string          `json:"session"`
+		Events  []PlaybackEvent `json:"events"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid playback events.")
+		return
+	}
+	if len(payload.Session) == 0 || len(payload.Session) > maxPlaybackSessionID {
+		Fail(w, r, CODE_INVALID_REQUEST, fmt.Sprintf("Session must be between 1 and %d characters.", maxPlaybackSessionID))
+		return
+	}
+	if len(payload.Events) == 0 || len(payload.Events) > maxPlaybackEvents {
+		Fail(w, r, CODE_INVALID_REQUEST, fmt.Sprintf("Between 1 and %d events must be sent.", maxPlaybackEvents))
+		return
+	}
+	for _, event := range payload.Events {
+		if event.Position < 0 || math.IsNaN(event.Position) || math.IsInf(event.Position, 0) {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid position.")
+			return
+		}
+		if len(event.Quality) > 16 {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid quality.")
+			return
+		}
+	}
+
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	totals, claim, err := s.playbackTotals(r.Context(), payload.Session, vid.ID, payload.Events)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if err := s.recordPlayback(vid.ID, totals); err != nil {
+		// Nothing was counted, the player can send the batch again.
+		if err := claim.Release(context.Background(), s.Redis); err != nil {
+			log.Printf("[%s] Failed to release playback claims: %v", RequestID(r), err)
+		}
+		FailInternal(w, r, err, "Failed to record playback.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"accepted":      len(payload.Events),
+		"watch_seconds": totals.WatchSeconds,
+	})
+}
+
+// Adds the totals of a batch to the counters of the video.
+func (s *Server) recordPlayback(videoID uint, totals *playbackTotals) error {
+	if err := ensureVideoStats(s.DB, videoID); err != nil {
+		return err
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&VideoStats{}).
+			Where("video_id = ?", videoID).
+			Updates(map[string]interface{}{
+				"watch_seconds":    gorm.Expr("watch_seconds + ?", totals.WatchSeconds),
+				"plays":            gorm.Expr("plays + ?", totals.Plays),
+				"completions":      gorm.Expr("completions + ?", totals.Completions),
+				"buffering_events": gorm.Expr("buffering_events + ?", totals.Buffering),
+			}).Error
+		if err != nil {
+			return err
+		}
+		err = recordDailyStats(tx, &VideoDailyStats{
+			VideoID:      videoID,
+			Day:          time.Now(),
+			Plays:        totals.Plays,
+			Completions:  totals.Completions,
+			WatchSeconds: totals.WatchSeconds,
+		})
+		if err != nil {
+			return err
+		}
+		return recordQualityStats(tx, videoID, totals.Qualities)
+	})
+}
+
+// How much of the video people watch, for the info responses.
+func videoEngagement(stats *VideoStats) map[string]interface{} {
+	engagement := map[string]interface{}{
+		"plays":                 stats.Plays,
+		"completions":           stats.Completions,
+		"completion_rate":       0.0,
+		"watch_seconds":         stats.WatchSeconds,
+		"average_watch_seconds": 0.0,
+	}
+	if stats.Plays > 0 {
+		engagement["completion_rate"] = float64(stats.Completions) / float64(stats.Plays)
+		engagement["average_watch_seconds"] = stats.WatchSeconds / float64(stats.Plays)
+	}
+	return engagement
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestAddUpPlayback(t *testing.T) {
+	cases := []struct {
+		name      string
+		position  float64
+		elapsed   float64
+		events    []PlaybackEvent
+		watched   float64
+		buffering int64
+		qualities map[string]float64
+		last      float64
+		completed bool
+	}{
+		{
+			name: "first heartbeat", position: -1, elapsed: 30,
+			events:  []PlaybackEvent{{Position: 0}, {Position: 10}, {Position: 20}},
+			watched: 20, last: 20,
+		},
+		{
+			name: "carries on", position: 20, elapsed: 30,
+			events:  []PlaybackEvent{{Position: 30, Quality: "720p"}, {Position: 40, Quality: "360p", Completed: true}},
+			watched: 20, last: 40, completed: true,
+			qualities: map[string]float64{"720p": 10, "360p": 10},
+		},
+		{
+			name: "seek and buffering", position: 0, elapsed: 300,
+			events:  []PlaybackEvent{{Position: 10}, {Position: 200}, {Position: 205, Buffering: true}, {Position: 210}},
+			watched: 15, buffering: 1, last: 210,
+		},
+		{
+			name: "faster than the clock", position: 0, elapsed: 45,
+			events:  []PlaybackEvent{{Position: 30, Quality: "720p"}, {Position: 60, Quality: "720p"}, {Position: 90, Quality: "360p"}},
+			watched: 45, last: 90,
+			qualities: map[string]float64{"720p": 30, "360p": 15},
+		},
+		{
+			name: "no time went by", position: 0, elapsed: 0,
+			events:  []PlaybackEvent{{Position: 30}},
+			watched: 0, last: 30,
+		},
+	}
+	for _, c := range cases {
+		totals, last, completed := addUpPlayback(c.position, c.elapsed, c.events)
+		if totals.WatchSeconds != c.watched || totals.Buffering != c.buffering {
+			t.Errorf("%s: got %+v, want %v seconds and %d buffering", c.name, totals, c.watched, c.buffering)
+		}
+		if len(totals.Qualities) != len(c.qualities) {
+			t.Errorf("%s: got qualities %v, want %v", c.name, totals.Qualities, c.qualities)
+		}
+		for quality, seconds := range c.qualities {
+			if totals.Qualities[quality] != seconds {
+				t.Errorf("%s: got qualities %v, want %v", c.name, totals.Qualities, c.qualities)
+			}
+		}
+		if last != c.last || completed != c.completed {
+			t.Errorf("%s: ended at %v (completed %v), want %v (%v)", c.name, last, completed, c.last, c.completed)
+		}
+	}
+}
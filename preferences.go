@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The column of NotificationPreference turning each kind of notification
+// off.
+var disabledNotificationColumns = map[video.NotificationType]string{
+	video.Like:    "disable_likes",
+	video.Comment: "disable_comments",
+}
+
+// Only keeps the users who want to hear about the video, given the kind of
+// notification. column holds the user ids in the query.
+func wantedNotifications(query *gorm.DB, column string, videoID uint, kind video.NotificationType) *gorm.DB {
+	query = query.Where(column+" NOT IN (?)", gorm.Expr("SELECT user_id FROM video_mutes WHERE video_id = ?", videoID))
+	if disabled, ok := disabledNotificationColumns[kind]; ok {
+		query = query.Where(column + " NOT IN (SELECT user_id FROM notification_preferences WHERE " + disabled + " = true)")
+	}
+	return query
+}
+
+// The preferences of the user, everything is on until they say otherwise.
+func notificationPreference(db *gorm.DB, userID uint) (*NotificationPreference, error) {
+	preference := &NotificationPreference{UserID: userID}
+	err := db.Where("user_id = ?", userID).First(preference).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return preference, nil
+	}
+	return preference, err
+}
+
+// What the user is told about, and the videos they muted.
+func (s *Server) notificationSettings(userID uint) (map[string]interface{}, error) {
+	preference, err := notificationPreference(s.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	muted := make([]uint, 0)
+	err = s.DB.Model(&VideoMute{}).Where("user_id = ?", userID).Order("video_id").Pluck("video_id", &muted).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"comments":     !preference.DisableComments,
+		"likes":        !preference.DisableLikes,
+		"follows":      !preference.DisableFollows,
+		"muted_videos": muted,
+	}, nil
+}
+
+func (s *Server) HandleGetNotificationPreferences(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := s.notificationSettings(usr.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get notification preferences.")
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, settings)
+}
+
+// Turns kinds of notifications on or off. Kinds left out of the body are
+// left as they are.
+func (s *Server) HandleUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Comments *bool `json:"comments"`
+		Likes    *bool `json:"likes"`
+		Follows  *bool `json:"follows"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid preferences.")
+		return
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		preference, err := notificationPreference(tx.Clauses(clause.Locking{Strength: "UPDATE"}), usr.ID)
+		if err != nil {
+			return err
+		}
+		if payload.Comments != nil {
+			preference.DisableComments = !*payload.Comments
+		}
+		if payload.Likes != nil {
+			preference.DisableLikes = !*payload.Likes
+		}
+		if payload.Follows != nil {
+			preference.DisableFollows = !*payload.Follows
+		}
+		return tx.Save(preference).Error
+	})
+	if err != nil {
+		FailInternal(w, r, err, "Failed to update notification preferences.")
+		return
+	}
+
+	settings, err := s.notificationSettings(usr.ID)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get notification preferences.")
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, settings)
+}
+
+// Stops or resumes the notifications about a video for the authenticated
+// user. Like likes, doing it twice is the same as doing it once.
+func (s *Server) setVideoMuted(w http.ResponseWriter, r *http.Request, p httprouter.Params, muted bool) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	vid, ok := s.videoParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	var err error
+	if muted {
+		err = s.DB.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&VideoMute{UserID: usr.ID, VideoID: vid.ID}).Error
+	} else {
+		err = s.DB.Where("user_id = ? AND video_id = ?", usr.ID, vid.ID).Delete(&VideoMute{}).Error
+	}
+	if err != nil {
+		FailInternal(w, r, err, "Failed to update mute.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"video_id": vid.ID,
+		"muted":    muted,
+	})
+}
+
+func (s *Server) HandleMuteVideo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setVideoMuted(w, r, p, true)
+}
+
+func (s *Server) HandleUnmuteVideo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.setVideoMuted(w, r, p, false)
+}
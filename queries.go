@@ -0,0 +1,35 @@
+// This file contains the queries the crud package doesn't have, or has in a
+// form which can't be used with request input.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"gorm.io/gorm"
+)
+
+/*----------------------
+|  Video
+-----------------------*/
+
+// Like crud.GetUserVideoFromUsername, but the video has to belong to the
+// user and the inputs are passed as parameters.
+func getUserVideo(db *gorm.DB, username, videoKey string) (*video.Video, error) {
+	vid := &video.Video{}
+	err := db.
+		Joins("JOIN users ON users.id = videos.user_id").
+		Where("users.username = ? AND videos.key = ?", username, videoKey).
+		First(vid).Error
+	return vid, err
+}
+
+// The error sent when a video couldn't be looked up. Not found is the
+// client's problem, anything else is ours.
+func videoLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return NewAPIError(CODE_VIDEO_NOT_FOUND, "Video not found.")
+	}
+	return Internal(err, "Failed to get video.")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Feed ranking modes.
+const (
+	// Engagement decayed by the age of the video.
+	RANKING_HOT = "hot"
+
+	// Engagement of the last few days, the latest day counting the most.
+	RANKING_TRENDING = "trending"
+
+	// Newest videos first.
+	RANKING_NEW = "new"
+
+	// Engagement of the last 7 days.
+	RANKING_TOP_WEEK = "top-week"
+)
+
+var rankingModes = []string{RANKING_HOT, RANKING_TRENDING, RANKING_NEW, RANKING_TOP_WEEK}
+
+func validRankingMode(mode string) bool {
+	for _, m := range rankingModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Days of activity looked at by the trending and top-week rankings.
+const (
+	trendingDays = 3
+	topWeekDays  = 7
+)
+
+// Each ranking keeps Size videos, picked among this many times as many of
+// the newest and of the most active videos.
+const rankingCandidatesFactor = 2
+
+const rankingLockKey = "ranking:lock"
+
+// Every refresh stores its rankings as new snapshots, the sorted sets of
+// video ids scored by the mode. A snapshot outlives the next refreshes so
+// a client paging through it sees a feed which doesn't move.
+func rankingSnapshotKey(mode, version string) string {
+	return fmt.Sprintf("ranking:%s:%s", mode, version)
+}
+
+// Holds the version of the latest snapshot of the mode.
+func rankingCurrentKey(mode string) string {
+	return fmt.Sprintf("ranking:%s:current", mode)
+}
+
+var errRankingExpired = NewAPIError(CODE_CURSOR_EXPIRED, "Feed expired, start again from the first page.")
+
+// What a video is ranked on.
+type rankingCandidate struct {
+	ID        uint
+	CreatedAt time.Time
+	AnalyticsCounts
+
+	// Activity of the last topWeekDays days, by day.
+	Daily []VideoDailyStats `gorm:"-"`
+}
+
+// Ranker precomputes the feed rankings into redis, so a feed page is a
+// range of a sorted set.
+type Ranker struct {
+	DB    *gorm.DB
+	Redis *redis.Client
+
+	Config RankingConfig
+}
+
+func NewRanker(db *gorm.DB, client *redis.Client, cfg RankingConfig) *Ranker {
+	return &Ranker{DB: db, Redis: client, Config: cfg}
+}
+
+// Engagement weighted by how much each kind of it is worth.
+func (r *Ranker) engagement(counts AnalyticsCounts) float64 {
+	return float64(counts.Views)*r.Config.ViewWeight +
+		float64(counts.Likes)*r.Config.LikeWeight +
+		float64(counts.Comments)*r.Config.CommentWeight +
+		float64(counts.Plays)*r.Config.PlayWeight +
+		float64(counts.Completions)*r.Config.CompletionWeight +
+		counts.WatchSeconds*r.Config.WatchSecondWeight
+}
+
+// Score of the video in the mode, at now.
+func (r *Ranker) Score(mode string, c *rankingCandidate, now time.Time) float64 {
+	switch mode {
+	case RANKING_HOT:
+		age := now.Sub(c.CreatedAt).Hours()
+		if age < 0 {
+			age = 0
+		}
+		return r.engagement(c.AnalyticsCounts) / math.Pow(age+2, r.Config.Gravity)
+
+	case RANKING_TRENDING, RANKING_TOP_WEEK:
+		today := statsDay(now)
+		score := 0.0
+		for _, day := range c.Daily {
+			age := int(math.Round(today.Sub(day.Day).Hours() / 24))
+			if age < 0 {
+				age = 0
+			}
+			activity := r.engagement(AnalyticsCounts{
+				Views:        day.Views,
+				Likes:        day.Likes,
+				Comments:     day.Comments,
+				Plays:        day.Plays,
+				Completions:  day.Completions,
+				WatchSeconds: day.WatchSeconds,
+			})
+			if mode == RANKING_TOP_WEEK {
+				score += activity
+			} else if age < trendingDays {
+				// Halved for every day it is old.
+				score += activity / float64(int64(1)<<age)
+			}
+		}
+		return score
+
+	case RANKING_NEW:
+		return float64(c.CreatedAt.Unix())
+	}
+	return 0
+}
+
+// The videos which can be in the feed, along with their counters. Rather
+// than every video, only the newest ones and the ones with the most activity
+// lately are looked at, which is where the best of every mode come from.
+func (r *Ranker) candidates(now time.Time) ([]rankingCandidate, error) {
+	candidates := make([]rankingCandidate, 0)
+	since := statsDay(now).AddDate(0, 0, 1-topWeekDays)
+	limit := rankingCandidatesFactor * r.Config.Size
+
+	newest := make([]uint, 0)
+	err := r.DB.Model(&video.Video{}).
+		Where("status >= ?", video.VIDEO_READY).
+		Order("created_at DESC").
+		Limit(limit).
+		Pluck("id", &newest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]uint, 0)
+	err = r.DB.Model(&VideoDailyStats{}).
+		Where("day >= ?", since).
+		Group("video_id").
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL: "SUM(views) * ? + SUM(likes) * ? + SUM(comments) * ? + SUM(plays) * ? + SUM(completions) * ? + SUM(watch_seconds) * ? DESC",
+			Vars: []interface{}{
+				r.Config.ViewWeight, r.Config.LikeWeight, r.Config.CommentWeight,
+				r.Config.PlayWeight, r.Config.CompletionWeight, r.Config.WatchSecondWeight,
+			},
+		}}).
+		Limit(limit).
+		Pluck("video_id", &active).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(newest)+len(active))
+	seen := make(map[uint]bool, len(newest)+len(active))
+	for _, id := range append(newest, active...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return candidates, nil
+	}
+
+	err = r.DB.Model(&video.Video{}).
+		Select("videos.id, videos.created_at, videos.views, "+
+			"COALESCE(video_stats.likes, 0) AS likes, COALESCE(video_stats.comments, 0) AS comments, "+
+			"COALESCE(video_stats.plays, 0) AS plays, COALESCE(video_stats.completions, 0) AS completions, "+
+			"COALESCE(video_stats.watch_seconds, 0) AS watch_seconds").
+		Joins("LEFT JOIN video_stats ON video_stats.video_id = videos.id").
+		Where("videos.id IN ? AND videos.status >= ?", ids, video.VIDEO_READY).
+		Scan(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	daily := make([]VideoDailyStats, 0)
+	err = r.DB.Where("day >= ? AND video_id IN ?", since, ids).Find(&daily).Error
+	if err != nil {
+		return nil, err
+	}
+	byVideo := make(map[uint][]VideoDailyStats)
+	for _, day := range daily {
+		byVideo[day.VideoID] = append(byVideo[day.VideoID], day)
+	}
+	for i := range candidates {
+		candidates[i].Daily = byVideo[candidates[i].ID]
+	}
+	return candidates, nil
+}
+
+// Refresh recomputes every ranking. Only one replica refreshes at a time,
+// the others skip their turn.
+func (r *Ranker) Refresh(ctx context.Context) error {
+	interval := time.Duration(r.Config.Interval)
+	release, locked, err := acquireLock(ctx, r.Redis, rankingLockKey, 2*interval+time.Minute)
+	if err != nil || !locked {
+		return err
+	}
+	defer release()
+
+	now := time.Now()
+	candidates, err := r.candidates(now)
+	if err != nil {
+		return err
+	}
+	for _, mode := range rankingModes {
+		if err := r.store(ctx, mode, candidates, now); err != nil {
+			return fmt.Errorf("failed to store %s ranking: %w", mode, err)
+		}
+	}
+	return nil
+}
+
+// Stores the best Size candidates as the new snapshot of the mode. It is
+// built aside and swapped in, readers never see half of it.
+func (r *Ranker) store(ctx context.Context, mode string, candidates []rankingCandidate, now time.Time) error {
+	members := make([]redis.Z, 0, len(candidates))
+	for i := range candidates {
+		score := r.Score(mode, &candidates[i], now)
+		if score <= 0 {
+			continue
+		}
+		members = append(members, redis.Z{Score: score, Member: candidates[i].ID})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Score > members[j].Score })
+	if len(members) > r.Config.Size {
+		members = members[:r.Config.Size]
+	}
+
+	// An empty ranking has no sorted set, only its version.
+	version := strconv.FormatInt(now.UnixNano(), 36)
+	building := rankingSnapshotKey(mode, "building")
+	_, err := r.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(members) > 0 {
+			pipe.Del(ctx, building)
+			pipe.ZAdd(ctx, building, members...)
+			pipe.Expire(ctx, building, time.Duration(r.Config.SnapshotTTL))
+			pipe.Rename(ctx, building, rankingSnapshotKey(mode, version))
+		}
+		pipe.Set(ctx, rankingCurrentKey(mode), version, 0)
+		return nil
+	})
+	return err
+}
+
+// Run refreshes the rankings until the context is cancelled.
+func (r *Ranker) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.Config.Interval))
+	defer ticker.Stop()
+
+	for {
+		if err := r.Refresh(ctx); err != nil {
+			log.Println("Failed to refresh rankings:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Current returns the version of the latest snapshot of the mode, empty
+// until it was ranked once. Ranking is left to Run, requests never wait on
+// it.
+func (r *Ranker) Current(ctx context.Context, mode string) (string, error) {
+	version, err := r.Redis.Get(ctx, rankingCurrentKey(mode)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return version, err
+}
+
+// Page returns the ids of the videos ranked offset to offset+count-1 in the
+// snapshot, and how many videos it has. Fails with errRankingExpired once
+// the snapshot is gone.
+func (r *Ranker) Page(ctx context.Context, mode, version string, offset, count int) ([]uint, int64, error) {
+	ids := make([]uint, 0, count)
+	if len(version) == 0 || count <= 0 {
+		return ids, 0, nil
+	}
+
+	key := rankingSnapshotKey(mode, version)
+	var total *redis.IntCmd
+	var members *redis.StringSliceCmd
+	_, err := r.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		total = pipe.ZCard(ctx, key)
+		members = pipe.ZRevRange(ctx, key, int64(offset), int64(offset+count-1))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if total.Val() == 0 {
+		// Either the ranking is empty, or the snapshot expired.
+		current, err := r.Redis.Get(ctx, rankingCurrentKey(mode)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, 0, err
+		}
+		if current != version {
+			return nil, 0, errRankingExpired
+		}
+		return ids, 0, nil
+	}
+
+	for _, member := range members.Val() {
+		id, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, total.Val(), nil
+}
+
+// Ranked returns the ids of the videos ranked offset to offset+count-1 in
+// the latest snapshot of the mode.
+func (r *Ranker) Ranked(ctx context.Context, mode string, offset, count int) ([]uint, error) {
+	version, err := r.Current(ctx, mode)
+	if err != nil {
+		return nil, err
+	}
+	ids, _, err := r.Page(ctx, mode, version, offset, count)
+	return ids, err
+}
+
+// The feed entries of the videos, in the order of ids. Videos which are
+// gone since they were ranked are left out.
+func rankedVideos(db *gorm.DB, ids []uint) ([]video.VideoWithUserEntry, error) {
+	entries := make([]video.VideoWithUserEntry, 0, len(ids))
+	if len(ids) == 0 {
+		return entries, nil
+	}
+
+	found := make([]video.VideoWithUserEntry, 0, len(ids))
+	err := db.Model(&video.Video{}).
+		Select("videos.id AS video_id, videos.name, videos.key, users.username, videos.views").
+		Joins("JOIN users ON users.id = videos.user_id").
+		Where("videos.id IN ?", ids).
+		Scan(&found).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]video.VideoWithUserEntry, len(found))
+	for _, entry := range found {
+		byID[entry.VideoID] = entry
+	}
+	for _, id := range ids {
+		if entry, ok := byID[id]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
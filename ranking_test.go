@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+)
+
+func TestRankingScore(t *testing.T) {
+	r := &Ranker{Config: RankingConfig{
+		ViewWeight:        1,
+		LikeWeight:        5,
+		CommentWeight:     10,
+		PlayWeight:        2,
+		CompletionWeight:  3,
+		WatchSecondWeight: 0.5,
+		Gravity:           1,
+	}}
+	now := time.Date(2023, 11, 2, 12, 0, 0, 0, time.UTC)
+	today := statsDay(now)
+
+	c := &rankingCandidate{
+		ID:              7,
+		CreatedAt:       now.Add(-2 * time.Hour),
+		AnalyticsCounts: AnalyticsCounts{Views: 10, Likes: 2, Comments: 1, Plays: 8, Completions: 4, WatchSeconds: 60},
+		Daily: []VideoDailyStats{
+			{VideoID: 7, Day: today, Plays: 2, Completions: 1, WatchSeconds: 10},
+			{VideoID: 7, Day: today.AddDate(0, 0, -1), Views: 4},
+			{VideoID: 7, Day: today.AddDate(0, 0, -5), Likes: 1},
+		},
+	}
+
+	cases := []struct {
+		mode string
+		want float64
+	}{
+		// 10 + 10 + 10 + 16 + 12 + 30, over the 2 hours it is old plus 2.
+		{RANKING_HOT, 88.0 / 4},
+		// 4 + 3 + 5 today, 4 halved yesterday, 5 days ago is too old.
+		{RANKING_TRENDING, 12 + 2},
+		{RANKING_TOP_WEEK, 12 + 4 + 5},
+	}
+	for _, tc := range cases {
+		if got := r.Score(tc.mode, c, now); got != tc.want {
+			t.Errorf("%s score = %v, want %v", tc.mode, got, tc.want)
+		}
+	}
+}
+
+// Only the newest and the most active videos are loaded.
+func TestRankingCandidates(t *testing.T) {
+	db, mock := newMockDB(t)
+	r := &Ranker{DB: db, Config: DefaultConfig().Ranking}
+	r.Config.Size = 5
+	now := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id` FROM `videos`") + ".*" + regexp.QuoteMeta("ORDER BY created_at DESC LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9).AddRow(8))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `video_id` FROM `video_daily_stats`") + ".*" + regexp.QuoteMeta("GROUP BY `video_id` ORDER BY SUM(views) * ?") + ".*" + regexp.QuoteMeta("DESC LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows([]string{"video_id"}).AddRow(8).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT videos.id")+".*"+regexp.QuoteMeta("videos.id IN (?,?,?)")).
+		WithArgs(9, 8, 3, video.VIDEO_READY).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "views"}).AddRow(9, now, 1).AddRow(8, now, 2).AddRow(3, now, 3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `video_daily_stats` WHERE day >= ? AND video_id IN (?,?,?)")).
+		WillReturnRows(sqlmock.NewRows([]string{"video_id", "day", "views"}).AddRow(3, statsDay(now), 3))
+
+	candidates, err := r.candidates(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 3 || len(candidates[2].Daily) != 1 || len(candidates[0].Daily) != 0 {
+		t.Fatalf("got %+v", candidates)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	// Every replica hears the notifications of every user, and hands them
+	// to the sockets it holds.
+	notificationsChannelPrefix = "notifications:"
+
+	// Notifications replayed at most when a socket reconnects. Anything
+	// older is left to the inbox.
+	maxReplayedNotifications = 100
+
+	// Messages waiting to be written to a socket. A client which falls
+	// further behind is dropped, and catches up when it reconnects.
+	socketBuffer = 64
+
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = socketPongWait * 9 / 10
+)
+
+// NotificationEvent is what the sockets are sent for each notification.
+type NotificationEvent struct {
+	ID      uint                   `json:"id"`
+	Type    video.NotificationType `json:"type"`
+	VideoID uint                   `json:"video_id"`
+	ActorID uint                   `json:"actor_id"`
+	Actor   string                 `json:"actor"`
+	Date    time.Time              `json:"date"`
+}
+
+func userNotificationsChannel(userID uint) string {
+	return fmt.Sprintf("%s%d", notificationsChannelPrefix, userID)
+}
+
+// NotificationHub delivers the notifications published over redis to the
+// sockets connected to this replica.
+type NotificationHub struct {
+	Redis *redis.Client
+
+	mu      sync.Mutex
+	sockets map[uint]map[*notificationSocket]struct{}
+}
+
+func NewNotificationHub(client *redis.Client) *NotificationHub {
+	return &NotificationHub{
+		Redis:   client,
+		sockets: make(map[uint]map[*notificationSocket]struct{}),
+	}
+}
+
+// Publish sends the notification to every replica.
+func (h *NotificationHub) Publish(ctx context.Context, userID uint, event NotificationEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return h.Redis.Publish(ctx, userNotificationsChannel(userID), payload).Err()
+}
+
+// Run delivers the published notifications until the context is cancelled.
+func (h *NotificationHub) Run(ctx context.Context) {
+	sub := h.Redis.PSubscribe(ctx, notificationsChannelPrefix+"*")
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		userID, err := strconv.ParseUint(strings.TrimPrefix(msg.Channel, notificationsChannelPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		event := NotificationEvent{}
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Println("Dropping malformed notification:", err)
+			continue
+		}
+		h.deliver(uint(userID), event)
+	}
+}
+
+func (h *NotificationHub) deliver(userID uint, event NotificationEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for socket := range h.sockets[userID] {
+		socket.send(event)
+	}
+}
+
+func (h *NotificationHub) register(socket *notificationSocket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sockets[socket.userID] == nil {
+		h.sockets[socket.userID] = make(map[*notificationSocket]struct{})
+	}
+	h.sockets[socket.userID][socket] = struct{}{}
+}
+
+func (h *NotificationHub) unregister(socket *notificationSocket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sockets[socket.userID], socket)
+	if len(h.sockets[socket.userID]) == 0 {
+		delete(h.sockets, socket.userID)
+	}
+}
+
+// A connected socket, with the events waiting to be written to it.
+type notificationSocket struct {
+	userID uint
+	events chan NotificationEvent
+
+	// Closed when the socket fell behind.
+	dropped chan struct{}
+	once    sync.Once
+}
+
+// Queues the event without ever blocking the hub.
+func (s *notificationSocket) send(event NotificationEvent) {
+	select {
+	case s.events <- event:
+	default:
+		s.once.Do(func() { close(s.dropped) })
+	}
+}
+
+// The notifications the user got after the one with the given id.
+func missedNotifications(db *gorm.DB, userID, after uint) ([]NotificationEvent, error) {
+	events := make([]NotificationEvent, 0)
+	err := db.Model(&video.VideoNotifications{}).
+		Select("video_notifications.id, video_notifications.type, video_notifications.video_id, video_notifications.actor_id, users.username AS actor, video_notifications.date").
+		Joins("LEFT JOIN users ON users.id = video_notifications.actor_id").
+		Where("video_notifications.user_id = ? AND video_notifications.id > ?", userID, after).
+		Order("video_notifications.id DESC").
+		Limit(maxReplayedNotifications).
+		Scan(&events).Error
+
+	// Oldest first, like they would have arrived.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, err
+}
+
+// Pushes the authenticated user's notifications as they happen. A client
+// reconnecting passes the id of the last notification it got as "since",
+// and is sent what it missed first. Fresh sockets only get the unread
+// count, the notifications themselves are listed by the REST endpoint.
+func (s *Server) HandleNotificationSocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usr, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	var since uint64
+	replay := false
+	if value := r.URL.Query().Get("since"); len(value) > 0 {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid since.")
+			return
+		}
+		since = parsed
+		replay = true
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return len(origin) == 0 || origin == s.Config.Server.AllowedOrigin
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the request.
+		log.Println("Failed to upgrade notification socket:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Listen before replaying, so nothing published in between is missed.
+	socket := &notificationSocket{
+		userID:  usr.ID,
+		events:  make(chan NotificationEvent, socketBuffer),
+		dropped: make(chan struct{}),
+	}
+	s.Notifications.register(socket)
+	defer s.Notifications.unregister(socket)
+
+	// Only pongs and the close message are expected from the client.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(socketPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(message map[string]interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		return conn.WriteJSON(message)
+	}
+
+	last := uint(since)
+	if replay {
+		missed, err := missedNotifications(s.DB, usr.ID, last)
+		if err != nil {
+			log.Println("Failed to replay notifications:", err)
+		}
+		for _, event := range missed {
+			if err := write(map[string]interface{}{"type": "notification", "notification": event}); err != nil {
+				return
+			}
+			last = event.ID
+		}
+	}
+	if unread, err := unreadNotificationCount(s.DB, usr.ID); err == nil {
+		if err := write(map[string]interface{}{"type": "unread", "unread": unread}); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(socketPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-socket.dropped:
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too far behind, reconnect"),
+				time.Now().Add(socketWriteWait),
+			)
+			return
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				return
+			}
+
+		case event := <-socket.events:
+			// Already sent by the replay.
+			if event.ID <= last {
+				continue
+			}
+			if err := write(map[string]interface{}{"type": "notification", "notification": event}); err != nil {
+				return
+			}
+			last = event.ID
+		}
+	}
+}
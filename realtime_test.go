@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+type socketMessage struct {
+	Type         string            `json:"type"`
+	Unread       int64             `json:"unread"`
+	Notification NotificationEvent `json:"notification"`
+}
+
+// Connects bob's notification socket, query is added to the url.
+func dialNotifications(t *testing.T, s *Server, query string) *websocket.Conn {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.HandleNotificationSocket(w, r, nil)
+	}))
+	t.Cleanup(srv.Close)
+
+	header := http.Header{}
+	header.Set("X-Username", "bob")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/notifications/ws"+query, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readSocketMessage(t *testing.T, conn *websocket.Conn) socketMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message := socketMessage{}
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func newSocketTestServer(t *testing.T, replay bool) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock := newMockDBMatching(t, sqlmock.QueryMatcherFunc(func(expected, actual string) error {
+		if !replay && strings.Contains(actual, "video_notifications.id >") {
+			t.Errorf("notifications replayed without since")
+		}
+		return sqlmock.QueryMatcherRegexp.Match(expected, actual)
+	}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users`")).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "username"}).AddRow(3, "bob"),
+	)
+	return &Server{Config: DefaultConfig(), DB: db, Notifications: NewNotificationHub(nil)}, mock
+}
+
+func expectUnreadCount(mock sqlmock.Sqlmock, unread int) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM `video_notifications`")).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(unread),
+	)
+}
+
+// A new socket isn't sent the old notifications, only the unread count and
+// what happens from then on.
+func TestNotificationSocketFresh(t *testing.T) {
+	s, mock := newSocketTestServer(t, false)
+	expectUnreadCount(mock, 5)
+
+	conn := dialNotifications(t, s, "")
+	if message := readSocketMessage(t, conn); message.Type != "unread" || message.Unread != 5 {
+		t.Fatalf("first message is %+v", message)
+	}
+
+	s.Notifications.deliver(3, NotificationEvent{ID: 50, Actor: "alice"})
+	if message := readSocketMessage(t, conn); message.Type != "notification" || message.Notification.ID != 50 {
+		t.Fatalf("got %+v, want notification 50", message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationSocketReplay(t *testing.T) {
+	s, mock := newSocketTestServer(t, true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT video_notifications.id")).
+		WithArgs(3, 40).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "actor"}).AddRow(42, "alice").AddRow(41, "carol"))
+	expectUnreadCount(mock, 2)
+
+	conn := dialNotifications(t, s, "?since=40")
+	for _, id := range []uint{41, 42} {
+		if message := readSocketMessage(t, conn); message.Type != "notification" || message.Notification.ID != id {
+			t.Fatalf("got %+v, want notification %d", message, id)
+		}
+	}
+	if message := readSocketMessage(t, conn); message.Type != "unread" || message.Unread != 2 {
+		t.Fatalf("got %+v, want the unread count", message)
+	}
+
+	// Whatever the replay already sent isn't sent again.
+	s.Notifications.deliver(3, NotificationEvent{ID: 42})
+	s.Notifications.deliver(3, NotificationEvent{ID: 43})
+	if message := readSocketMessage(t, conn); message.Notification.ID != 43 {
+		t.Fatalf("got %+v, want notification 43", message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationSocketInvalidSince(t *testing.T) {
+	s, _ := newSocketTestServer(t, false)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.HandleNotificationSocket(w, r, nil)
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("X-Username", "bob")
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?since=yesterday", header)
+	if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("dial returned %v %v", res, err)
+	}
+}
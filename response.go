@@ -0,0 +1,234 @@
+// This file contains the shape of every JSON response the API sends.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/dchest/uniuri"
+)
+
+// ErrorCode tells clients what went wrong without parsing the message. The
+// codes are part of the API, never rename one.
+type ErrorCode string
+
+const (
+	CODE_INVALID_REQUEST    ErrorCode = "invalid_request"
+	CODE_UNAUTHENTICATED    ErrorCode = "unauthenticated"
+	CODE_FORBIDDEN          ErrorCode = "forbidden"
+	CODE_NOT_FOUND          ErrorCode = "not_found"
+	CODE_METHOD_NOT_ALLOWED ErrorCode = "method_not_allowed"
+	CODE_CONFLICT           ErrorCode = "conflict"
+	CODE_NOT_SUPPORTED      ErrorCode = "not_supported"
+	CODE_INTERNAL           ErrorCode = "internal_error"
+
+	CODE_USER_NOT_FOUND    ErrorCode = "user_not_found"
+	CODE_VIDEO_NOT_FOUND   ErrorCode = "video_not_found"
+	CODE_COMMENT_NOT_FOUND ErrorCode = "comment_not_found"
+	CODE_CURSOR_EXPIRED    ErrorCode = "cursor_expired"
+
+	CODE_PLAYBACK_EXPIRED ErrorCode = "playback_session_expired"
+
+	CODE_UPLOAD_NOT_FOUND   ErrorCode = "upload_not_found"
+	CODE_UPLOAD_EXPIRED     ErrorCode = "upload_expired"
+	CODE_UPLOAD_CLOSED      ErrorCode = "upload_closed"
+	CODE_UPLOAD_INCOMPLETE  ErrorCode = "upload_incomplete"
+	CODE_VIDEO_NOT_UPLOADED ErrorCode = "video_not_uploaded"
+	CODE_VIDEO_TOO_LARGE    ErrorCode = "video_too_large"
+	CODE_UNSUPPORTED_VIDEO  ErrorCode = "unsupported_video_type"
+)
+
+// The http status sent with each code.
+var errorStatus = map[ErrorCode]int{
+	CODE_INVALID_REQUEST:    http.StatusBadRequest,
+	CODE_UNAUTHENTICATED:    http.StatusUnauthorized,
+	CODE_FORBIDDEN:          http.StatusForbidden,
+	CODE_NOT_FOUND:          http.StatusNotFound,
+	CODE_METHOD_NOT_ALLOWED: http.StatusMethodNotAllowed,
+	CODE_CONFLICT:           http.StatusConflict,
+	CODE_NOT_SUPPORTED:      http.StatusNotImplemented,
+	CODE_INTERNAL:           http.StatusInternalServerError,
+
+	CODE_USER_NOT_FOUND:    http.StatusNotFound,
+	CODE_VIDEO_NOT_FOUND:   http.StatusNotFound,
+	CODE_COMMENT_NOT_FOUND: http.StatusNotFound,
+	CODE_CURSOR_EXPIRED:    http.StatusGone,
+
+	CODE_PLAYBACK_EXPIRED: http.StatusGone,
+
+	CODE_UPLOAD_NOT_FOUND:   http.StatusNotFound,
+	CODE_UPLOAD_EXPIRED:     http.StatusGone,
+	CODE_UPLOAD_CLOSED:      http.StatusConflict,
+	CODE_UPLOAD_INCOMPLETE:  http.StatusConflict,
+	CODE_VIDEO_NOT_UPLOADED: http.StatusBadRequest,
+	CODE_VIDEO_TOO_LARGE:    http.StatusRequestEntityTooLarge,
+	CODE_UNSUPPORTED_VIDEO:  http.StatusUnsupportedMediaType,
+}
+
+// APIError is an error the client is told about. Cause is only logged.
+type APIError struct {
+	Code    ErrorCode
+	Message string
+	Cause   error
+}
+
+func NewAPIError(code ErrorCode, message string) *APIError {
+	return &APIError{Code: code, Message: message}
+}
+
+// Internal is an unexpected failure, the message is all the client sees.
+func Internal(cause error, message string) *APIError {
+	return &APIError{Code: CODE_INTERNAL, Message: message, Cause: cause}
+}
+
+// orInternal keeps an *APIError as it is, e.g. one returned from inside of
+// a transaction. Anything else is an internal error with the message.
+func orInternal(err error, message string) error {
+	apiErr := &APIError{}
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return Internal(err, message)
+}
+
+func (e *APIError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *APIError) Status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+/*----------------------
+|  Request ID
+-----------------------*/
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Gives every request an ID, which is sent back and attached to the logs.
+// An ID set by the proxy in front of us is kept.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if len(id) == 0 || len(id) > 64 {
+			id = uniuri.NewLen(20)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+/*----------------------
+|  Responses
+-----------------------*/
+
+// WriteJSON sends a successful response. The body's keys are sent as they
+// are, next to "success" and "request_id".
+func WriteJSON(w http.ResponseWriter, r *http.Request, status int, body map[string]interface{}) {
+	if body == nil {
+		body = map[string]interface{}{}
+	}
+	body["success"] = true
+	body["request_id"] = RequestID(r)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[%s] Failed to write response: %v", RequestID(r), err)
+	}
+}
+
+// WriteError sends the error. Anything which isn't an *APIError is an
+// internal error, and is only logged.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := &APIError{}
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err, "Something went wrong.")
+	}
+
+	status := apiErr.Status()
+	if status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s: %v", RequestID(r), r.Method, r.URL.Path, apiErr)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": apiErr.Message,
+		"error": map[string]interface{}{
+			"code":    apiErr.Code,
+			"message": apiErr.Message,
+		},
+		"request_id": RequestID(r),
+	})
+}
+
+// Fail sends an error with the code.
+func Fail(w http.ResponseWriter, r *http.Request, code ErrorCode, message string) {
+	WriteError(w, r, NewAPIError(code, message))
+}
+
+// FailInternal logs the cause and sends an internal error with the message.
+func FailInternal(w http.ResponseWriter, r *http.Request, cause error, message string) {
+	WriteError(w, r, Internal(cause, message))
+}
+
+/*----------------------
+|  Pagination
+-----------------------*/
+
+// Cursors are where the previous page ended. The client gets them base64
+// encoded and hands them back as they are.
+func encodeCursor(cursor interface{}) string {
+	payload, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeCursor(value string, cursor interface{}) error {
+	payload, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(payload, cursor)
+	}
+	if err != nil {
+		return NewAPIError(CODE_INVALID_REQUEST, "Invalid cursor.")
+	}
+	return nil
+}
+
+// Reads the "limit" query parameter.
+func pageLimit(r *http.Request, fallback, max int) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > max {
+		return 0, NewAPIError(CODE_INVALID_REQUEST, fmt.Sprintf("Limit must be between 1 and %d.", max))
+	}
+	return limit, nil
+}
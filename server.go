@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/hibiken/asynq"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/cors"
+	"gorm.io/gorm"
+)
+
+// TaskQueue is the part of the asynq client the handlers use. It lets the
+// handlers be tested without a running redis.
+type TaskQueue interface {
+	Enqueue(task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+}
+
+// TaskInspector is the part of the asynq inspector used to follow the
+// tasks which were queued.
+type TaskInspector interface {
+	GetTaskInfo(queue, id string) (*asynq.TaskInfo, error)
+}
+
+// Server holds everything the http handlers depend on. The handlers are
+// methods on it, so nothing is read from globals or from the request context.
+type Server struct {
+	Config    *Config
+	DB        *gorm.DB
+	Redis     *redis.Client
+	Queue     TaskQueue
+	Inspector TaskInspector
+	Storage   Storage
+	Playlists PlaylistCache
+	Events    *VideoEvents
+	Outbox    *OutboxDispatcher
+
+	// Pushes notifications to the sockets connected to this replica.
+	Notifications *NotificationHub
+
+	// Counts the views of the videos.
+	Views *ViewCounter
+
+	// The feed rankings.
+	Rankings *Ranker
+
+	// Proxies whose X-Forwarded-For is believed.
+	trustedProxies []*net.IPNet
+
+	playlistGroup playlistGroup
+}
+
+// NewServer connects to every dependency described by the configuration.
+func NewServer(cfg *Config) (*Server, error) {
+	connection, err := OpenDatabase(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+
+	proxies, err := cfg.TrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStorage(cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	queue := asynq.NewClient(asynq.RedisClientOpt{
+		Addr: cfg.RedisAddr(),
+	})
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{
+		Addr: cfg.RedisAddr(),
+	})
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: cfg.RedisAddr(),
+	})
+
+	playlists, err := newPlaylistCache(cfg.Cache, redisClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the playlist cache: %w", err)
+	}
+
+	events := &VideoEvents{Redis: redisClient}
+
+	return &Server{
+		Config:    cfg,
+		DB:        connection,
+		Redis:     redisClient,
+		Queue:     queue,
+		Inspector: inspector,
+		Storage:   store,
+		Playlists: playlists,
+		Events:    events,
+		Outbox:    NewOutboxDispatcher(connection, queue, events, cfg.Outbox),
+
+		Notifications: NewNotificationHub(redisClient),
+		Views:         NewViewCounter(connection, redisClient, cfg.Views),
+		Rankings:      NewRanker(connection, redisClient, cfg.Ranking),
+
+		trustedProxies: proxies,
+	}, nil
+}
+
+// Routes returns the http handler serving the whole API.
+func (s *Server) Routes() http.Handler {
+	mux := httprouter.New()
+
+	// Errors raised by the router get the same body as the handlers'.
+	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Fail(w, r, CODE_NOT_FOUND, "Not found.")
+	})
+	mux.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Fail(w, r, CODE_METHOD_NOT_ALLOWED, "Invalid method.")
+	})
+	mux.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		FailInternal(w, r, fmt.Errorf("panic: %v", v), "Something went wrong.")
+	}
+
+	mux.GET("/upload", s.GetUploadPresignedUrl)
+
+	// Resumable uploads, the video is sent in parts.
+	mux.POST("/upload/multipart", s.CreateMultipartUpload)
+	mux.GET("/upload/multipart/:key/parts", s.ListMultipartUploadParts)
+	mux.GET("/upload/multipart/:key/parts/:part", s.GetMultipartUploadPartUrl)
+	mux.POST("/upload/multipart/:key/complete", s.CompleteMultipartUpload)
+	mux.DELETE("/upload/multipart/:key", s.AbortMultipartUpload)
+	mux.POST("/save", s.HandleVideoSave)
+
+	// The following endpoint uses database:
+	mux.GET("/users/:user/videos/:video", s.VideoHandler)
+	mux.GET("/users/:user/videos/:video/playlists/*path", s.VideoVariantHandler)
+
+	// Retrieve enough information for the frontend to be able to render.
+	mux.GET("/users/:user/videos/:video/info", s.HandleVideoInfo)
+	mux.GET("/users/:user/videos/:video/status", s.HandleVideoStatus)
+	mux.GET("/users/:user/videos/:video/events", s.HandleVideoEvents)
+	mux.GET("/watch/:user/:video/info", s.HandleVideoWatchInfo)
+	mux.GET("/video/feed", s.HandleFeed)
+	mux.GET("/video/feed/:amount/:page", s.VideoFeedHandler)
+	mux.GET("/video/rank/:rank", s.GetVideoByRank)
+	mux.GET("/users/:user/videos", s.GetUserVideos)
+	mux.GET("/users/:user/analytics", s.HandleUserAnalytics)
+
+	// Comments, made as the authenticated user.
+	mux.GET("/videos/:id/comments", s.HandleListComments)
+	mux.POST("/videos/:id/comments", s.HandleCreateComment)
+	mux.PATCH("/videos/:id/comments/:comment", s.HandleEditComment)
+	mux.DELETE("/videos/:id/comments/:comment", s.HandleDeleteComment)
+	mux.GET("/videos/:id/comments/:comment/history", s.HandleCommentHistory)
+
+	// Likes, made as the authenticated user.
+	mux.PUT("/videos/:id/like", s.HandleLikeVideo)
+	mux.DELETE("/videos/:id/like", s.HandleUnlikeVideo)
+
+	// Stops the notifications about the video.
+	mux.PUT("/videos/:id/mute", s.HandleMuteVideo)
+	mux.DELETE("/videos/:id/mute", s.HandleUnmuteVideo)
+
+	// Heartbeats of the players, anyone watching can send them in a
+	// session they were given.
+	mux.POST("/videos/:id/playback-sessions", s.HandleCreatePlaybackSession)
+	mux.POST("/videos/:id/playback-events", s.HandlePlaybackEvents)
+
+	// The authenticated user's notifications.
+	mux.GET("/notifications", s.HandleListNotifications)
+	mux.GET("/notifications/unread", s.HandleUnreadNotifications)
+	mux.POST("/notifications/:id/read", s.HandleReadNotification)
+	mux.GET("/notifications/ws", s.HandleNotificationSocket)
+	mux.GET("/notifications/preferences", s.HandleGetNotificationPreferences)
+	mux.PUT("/notifications/preferences", s.HandleUpdateNotificationPreferences)
+
+	// Moderation by the video's owner.
+	mux.PUT("/videos/:id/comments/:comment/hidden", s.HandleHideComment)
+	mux.DELETE("/videos/:id/comments/:comment/hidden", s.HandleShowComment)
+
+	// Serve the presigned urls when running against a local directory.
+	if local, ok := s.Storage.(*LocalStorage); ok {
+		mux.Handler("GET", "/storage/*key", local)
+		mux.Handler("PUT", "/storage/*key", local)
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   []string{s.Config.Server.AllowedOrigin},
+		AllowCredentials: true,
+		AllowedHeaders: []string{
+			"Hx-Current-Url",
+			"Hx-Request",
+			"Hx-Target",
+			"Hx-Boosted",
+			"Hx-Current-Url",
+			"Hx-Request",
+			"Hx-Trigger",
+			"Content-Type",
+			"X-Custom-Header",
+			"X-Username",
+			requestIDHeader,
+			"*",
+		},
+		AllowedMethods: []string{
+			"POST",
+			"GET",
+			"PUT",
+			"PATCH",
+			"DELETE",
+			"OPTIONS",
+			"*",
+		},
+
+		// Multipart uploads need the ETag of every part, which includes
+		// the parts sent to the local storage. The request ID is what to
+		// quote when reporting an error.
+		ExposedHeaders: []string{"ETag", requestIDHeader},
+
+		// Enable Debugging for testing, consider disabling in production
+		Debug: (s.Config.Server.Mode == "DEBUG"),
+	}).Handler(withRequestID(mux))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/functions/crud"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Makes sure the video has its counters. Videos made before they existed
+// get them counted from the rows they count.
+func ensureVideoStats(db *gorm.DB, videoID uint) error {
+	err := db.Select("video_id").First(&VideoStats{}, videoID).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	stats, err := countVideoStats(db, videoID)
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(stats).Error
+}
+
+// Counts the counters of a video which doesn't have them yet. Only likes
+// and comments were around before the counters.
+func countVideoStats(db *gorm.DB, videoID uint) (*VideoStats, error) {
+	stats := &VideoStats{
+		VideoID: videoID,
+		Likes:   crud.GetVideoLikeCount(db, videoID),
+	}
+	err := db.Model(&Comment{}).Where("video_id = ?", videoID).Count(&stats.Comments).Error
+	return stats, err
+}
+
+// Returns the counters of the video. They are counted, but not saved, for
+// the videos which don't have them yet, reads never write.
+func getVideoStats(db *gorm.DB, videoID uint) (*VideoStats, error) {
+	stats := &VideoStats{}
+	err := db.Where("video_id = ?", videoID).First(stats).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return countVideoStats(db, videoID)
+	}
+	return stats, err
+}
+
+// Locks the counters of the video until the transaction ends, so they can
+// be changed along with the rows they count. ensureVideoStats has to be
+// called before the transaction starts.
+func lockVideoStats(tx *gorm.DB, videoID uint) (*VideoStats, error) {
+	stats := &VideoStats{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(stats, videoID).Error
+	return stats, err
+}
+
+// Adds delta to the counter, which is a column of VideoStats.
+func incrementVideoStat(tx *gorm.DB, videoID uint, column string, delta int64) error {
+	return tx.Model(&VideoStats{}).
+		Where("video_id = ?", videoID).
+		Update(column, gorm.Expr(column+" + ?", delta)).Error
+}
+
+// The UTC day things happening at t are counted in. It is returned as
+// midnight in the database's location, so the driver writes the same date.
+func statsDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// Adds the watch seconds of each quality to the video's.
+func recordQualityStats(tx *gorm.DB, videoID uint, qualities map[string]float64) error {
+	if len(qualities) == 0 {
+		return nil
+	}
+	rows := make([]VideoQualityStats, 0, len(qualities))
+	for quality, seconds := range qualities {
+		rows = append(rows, VideoQualityStats{VideoID: videoID, Quality: quality, WatchSeconds: seconds})
+	}
+	// Always in the same order, so the rows are locked in the same order.
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Quality < rows[j].Quality })
+
+	return tx.Clauses(clause.OnConflict{
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"watch_seconds": gorm.Expr("watch_seconds + VALUES(watch_seconds)"),
+		}),
+	}).Create(&rows).Error
+}
+
+// Adds the counts of delta to its video's day, VideoID and Day say which.
+func recordDailyStats(tx *gorm.DB, delta *VideoDailyStats) error {
+	delta.Day = statsDay(delta.Day)
+	return tx.Clauses(clause.OnConflict{
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"views":         gorm.Expr("views + VALUES(views)"),
+			"likes":         gorm.Expr("likes + VALUES(likes)"),
+			"comments":      gorm.Expr("comments + VALUES(comments)"),
+			"plays":         gorm.Expr("plays + VALUES(plays)"),
+			"completions":   gorm.Expr("completions + VALUES(completions)"),
+			"watch_seconds": gorm.Expr("watch_seconds + VALUES(watch_seconds)"),
+		}),
+	}).Create(delta).Error
+}
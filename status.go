@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/hibiken/asynq"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// The statuses a video can move to from each status. A failed video may
+// still be picked up again, e.g. when its task is retried from the queue.
+var statusTransitions = map[string][]string{
+	STATUS_UPLOADED:   {STATUS_QUEUED, STATUS_FAILED},
+	STATUS_QUEUED:     {STATUS_PROCESSING, STATUS_READY, STATUS_FAILED},
+	STATUS_PROCESSING: {STATUS_READY, STATUS_FAILED},
+	STATUS_FAILED:     {STATUS_QUEUED, STATUS_PROCESSING, STATUS_READY},
+	STATUS_READY:      {},
+}
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+func CanTransition(from, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NewVideoStatus is the status of a video which was just uploaded.
+func NewVideoStatus(videoID uint) *VideoStatus {
+	return &VideoStatus{
+		VideoID: videoID,
+		Status:  STATUS_UPLOADED,
+	}
+}
+
+// Transition moves the video to the status, recording when it happened.
+// The reason is only kept when the video failed.
+func (v *VideoStatus) Transition(to, reason string) error {
+	if v.Status == to {
+		return nil
+	}
+	if !CanTransition(v.Status, to) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, v.Status, to)
+	}
+
+	now := time.Now()
+	v.Status = to
+	v.Error = ""
+	switch to {
+	case STATUS_QUEUED:
+		v.QueuedAt = &now
+	case STATUS_PROCESSING:
+		v.ProcessingAt = &now
+	case STATUS_READY:
+		v.ReadyAt = &now
+	case STATUS_FAILED:
+		v.FailedAt = &now
+		v.Error = reason
+	}
+	return nil
+}
+
+// How far the worker got, in percent. The worker counts its finished steps
+// in the video's Status, up to VIDEO_READY.
+func (v *VideoStatus) Progress(vid *video.Video) int {
+	switch v.Status {
+	case STATUS_READY:
+		return 100
+	case STATUS_PROCESSING:
+		return int(vid.Status) * 100 / int(video.VIDEO_READY)
+	}
+	return 0
+}
+
+// Moves the status of the video, when it has one. Transitions which aren't
+// allowed are logged and skipped, so they don't fail the caller. The status
+// is only returned when it was saved.
+func transitionVideoStatus(tx *gorm.DB, videoID uint, to, reason string, update func(*VideoStatus)) (*VideoStatus, error) {
+	status := &VideoStatus{}
+	err := tx.Where(&VideoStatus{VideoID: videoID}).First(status).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := status.Transition(to, reason); err != nil {
+		log.Printf("Video %d: %v", videoID, err)
+		return nil, nil
+	}
+	if update != nil {
+		update(status)
+	}
+	return status, tx.Save(status).Error
+}
+
+// Returns the status of the video, brought up to date with the worker's
+// progress and the queue.
+func (s *Server) videoStatus(vid *video.Video) (*VideoStatus, error) {
+	status := &VideoStatus{}
+	err := s.DB.Where(&VideoStatus{VideoID: vid.ID}).First(status).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Uploaded before the statuses were tracked, all we know is how
+		// far the worker got.
+		status = NewVideoStatus(vid.ID)
+		status.Status = STATUS_PROCESSING
+		if vid.Status >= video.VIDEO_READY {
+			status.Status = STATUS_READY
+		}
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	to, reason := s.reconcileVideoStatus(vid, status)
+	if to == status.Status || !CanTransition(status.Status, to) {
+		return status, nil
+	}
+	if err := status.Transition(to, reason); err != nil {
+		return nil, err
+	}
+	if err := s.DB.Save(status).Error; err != nil {
+		return nil, err
+	}
+
+	err = s.Events.Publish(context.Background(), vid.Key, VideoEvent{
+		Status:   status.Status,
+		Progress: status.Progress(vid),
+		Error:    status.Error,
+	})
+	if err != nil {
+		log.Println("Failed to publish video event:", err)
+	}
+	return status, nil
+}
+
+// Works out the status the video should be in.
+func (s *Server) reconcileVideoStatus(vid *video.Video, status *VideoStatus) (string, string) {
+	// The worker's progress is the most reliable.
+	if vid.Status >= video.VIDEO_READY {
+		return STATUS_READY, ""
+	}
+	if vid.Status > video.VIDEO_CONVERTING {
+		return STATUS_PROCESSING, ""
+	}
+
+	// Otherwise ask the queue what happened to the task.
+	if len(status.TaskID) == 0 || s.Inspector == nil {
+		return status.Status, ""
+	}
+	info, err := s.Inspector.GetTaskInfo(status.Queue, status.TaskID)
+	if err != nil {
+		if !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+			log.Println("Failed to inspect task:", err)
+		}
+		return status.Status, ""
+	}
+
+	switch info.State {
+	case asynq.TaskStateActive, asynq.TaskStateRetry, asynq.TaskStateCompleted:
+		return STATUS_PROCESSING, ""
+	case asynq.TaskStateArchived:
+		return STATUS_FAILED, info.LastErr
+	}
+	return status.Status, ""
+}
+
+// Tells the uploader how far the processing of their video got.
+func (s *Server) HandleVideoStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	videoName := p.ByName("video")
+	username := p.ByName("user")
+	if len(videoName) == 0 || len(username) == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Video name/username not specified.")
+		return
+	}
+
+	// Failure reasons are only for the owner's eyes.
+	if !requireOwner(w, r, username, "Only the owner can see the video's status.") {
+		return
+	}
+
+	vid, err := getUserVideo(s.DB, username, videoName)
+	if err != nil {
+		WriteError(w, r, videoLookupError(err))
+		return
+	}
+
+	status, err := s.videoStatus(vid)
+	if err != nil {
+		FailInternal(w, r, err, "Failed to get video status.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"status":   status,
+		"progress": status.Progress(vid),
+	})
+}
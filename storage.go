@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long presigned urls stay valid. This matches the default used by the
+// aws presign client.
+const defaultPresignExpiry = 15 * time.Minute
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// Storage is everything the backend needs from the object store. Keys are
+// always slash separated, e.g. "users/<name>/videos/<key>/vid".
+type Storage interface {
+	// GetObject returns the content of the object. The caller must close it.
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// PresignGet returns a url which allows anyone to download the object.
+	PresignGet(ctx context.Context, key string) (string, error)
+
+	// PresignPut returns a url which allows anyone to upload the object.
+	PresignPut(ctx context.Context, key string) (string, error)
+
+	// List returns the keys of every object starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Stat returns the metadata of the object without downloading it.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// Creates the object store selected by the configuration.
+func newStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Backend {
+	case "s3":
+		client, err := GetS3Client(cfg.Region, cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		store := NewS3Storage(client, cfg.Bucket)
+		store.Expiry = time.Duration(cfg.PresignExpiry)
+		return store, nil
+	case "local":
+		store, err := NewLocalStorage(cfg.Dir, cfg.URL, []byte(cfg.Secret))
+		if err != nil {
+			return nil, err
+		}
+		store.Expiry = time.Duration(cfg.PresignExpiry)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+/*----------------------
+|  S3 / Spaces
+-----------------------*/
+
+// S3Storage stores objects in an S3 compatible bucket (DigitalOcean Spaces).
+type S3Storage struct {
+	Client *s3.Client
+	Bucket string
+	Expiry time.Duration
+
+	presign *s3.PresignClient
+}
+
+func NewS3Storage(client *s3.Client, bucket string) *S3Storage {
+	return &S3Storage{
+		Client:  client,
+		Bucket:  bucket,
+		Expiry:  defaultPresignExpiry,
+		presign: s3.NewPresignClient(client),
+	}
+}
+
+func (s *S3Storage) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return object.Body, nil
+}
+
+func (s *S3Storage) PresignGet(ctx context.Context, key string) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(s.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3Storage) PresignPut(ctx context.Context, key string) (string, error) {
+	req, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(s.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	head, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:         head.ContentLength,
+		ContentType:  aws.ToString(head.ContentType),
+		LastModified: aws.ToTime(head.LastModified),
+	}, nil
+}
+
+/*----------------------
+|  Local filesystem
+-----------------------*/
+
+// LocalStorage stores objects as files under Root. It is meant for running
+// the backend offline, the presigned urls point back at ServeHTTP which must
+// be mounted at BaseURL.
+type LocalStorage struct {
+	// Directory holding the objects.
+	Root string
+
+	// Public url the storage routes are served from,
+	// e.g. "http://localhost:7000/storage".
+	BaseURL string
+
+	// Key used to sign the urls.
+	Secret []byte
+
+	Expiry time.Duration
+}
+
+func NewLocalStorage(root, baseURL string, secret []byte) (*LocalStorage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{
+		Root:    root,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Secret:  secret,
+		Expiry:  defaultPresignExpiry,
+	}, nil
+}
+
+// Maps a key onto a path inside of Root. Keys can't escape the root.
+func (l *LocalStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(cleaned)), nil
+}
+
+func (l *LocalStorage) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return file, err
+}
+
+func (l *LocalStorage) PresignGet(ctx context.Context, key string) (string, error) {
+	return l.sign(http.MethodGet, key)
+}
+
+func (l *LocalStorage) PresignPut(ctx context.Context, key string) (string, error) {
+	return l.sign(http.MethodPut, key)
+}
+
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.Walk(l.Root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Parts of unfinished multipart uploads aren't objects.
+			if info.Name() == localMultipartDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// The content type isn't stored alongside the files, it is sniffed from
+// the beginning of the file instead.
+func (l *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Size:         info.Size(),
+		ContentType:  http.DetectContentType(head[:n]),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (l *LocalStorage) signature(method, key string, expires int64) string {
+	mac := hmac.New(sha256.New, l.Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *LocalStorage) sign(method, key string) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(l.Expiry).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", l.signature(method, key, expires))
+	return fmt.Sprintf("%s/%s?%s", l.BaseURL, key, query.Encode()), nil
+}
+
+// ServeHTTP serves the presigned urls. It expects to be mounted on a
+// catch all route named "key", e.g. "/storage/*key".
+func (l *LocalStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("key"), "/")
+
+	// Make sure the url was signed by us and is still valid.
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		Fail(w, r, CODE_FORBIDDEN, "Url expired.")
+		return
+	}
+	expected := l.signature(r.Method, key, expires)
+	if !hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("signature"))) {
+		Fail(w, r, CODE_FORBIDDEN, "Invalid signature.")
+		return
+	}
+
+	p, err := l.path(key)
+	if err != nil {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid key.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		http.ServeFile(w, r, p)
+	case http.MethodPut:
+		etag, err := writeFile(p, r.Body)
+		if err != nil {
+			FailInternal(w, r, err, "Failed to store object.")
+			return
+		}
+		// Multipart clients need the etag of every part to complete.
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+	default:
+		Fail(w, r, CODE_METHOD_NOT_ALLOWED, "Invalid method.")
+	}
+}
+
+// Writes the file aside and moves it into place once it is complete, an
+// interrupted upload never leaves half an object behind. Returns the etag of
+// the content.
+func writeFile(p string, content io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", p, time.Now().UnixNano())
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), content); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%q", hex.EncodeToString(hash.Sum(nil))), nil
+}
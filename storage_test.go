@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Starts a server serving the local storage the same way Routes does.
+func newLocalStorageServer(t *testing.T) (*LocalStorage, *httptest.Server) {
+	t.Helper()
+
+	mux := httprouter.New()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	local, err := NewLocalStorage(t.TempDir(), srv.URL+"/storage/", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handler("GET", "/storage/*key", local)
+	mux.Handler("PUT", "/storage/*key", local)
+	mux.Handler("DELETE", "/storage/*key", local)
+	return local, srv
+}
+
+// Sends the request and returns the status and the error code, if any.
+func doStorageRequest(t *testing.T, method, rawURL string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode < http.StatusBadRequest {
+		return res, string(payload)
+	}
+	var failure struct {
+		Error struct {
+			Code ErrorCode `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &failure); err != nil {
+		t.Fatalf("error response isn't json: %q", payload)
+	}
+	return res, string(failure.Error.Code)
+}
+
+func TestLocalStorageSign(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage/", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Expiry = time.Hour
+
+	before := time.Now().Add(time.Hour).Unix()
+	signed, err := local.PresignGet(context.Background(), "users/bob/videos/abc/vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Hour).Unix()
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != "http://localhost:7000/storage/users/bob/videos/abc/vid" {
+		t.Fatalf("signed url points at %q", got)
+	}
+
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("bad expires: %v", err)
+	}
+	if expires < before || expires > after {
+		t.Fatalf("expires %d isn't an hour from now", expires)
+	}
+	if got, want := u.Query().Get("signature"), local.signature(http.MethodGet, "users/bob/videos/abc/vid", expires); got != want {
+		t.Fatalf("signature = %q, want %q", got, want)
+	}
+
+	// The method is part of the signature, so a get url can't be used to
+	// upload.
+	put, err := local.PresignPut(context.Background(), "users/bob/videos/abc/vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu, _ := url.Parse(put)
+	if pu.Query().Get("signature") == u.Query().Get("signature") {
+		t.Fatal("get and put urls share a signature")
+	}
+}
+
+func TestLocalStorageSignRejectsBadKeys(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "/", "..", "../.."} {
+		if _, err := local.PresignGet(context.Background(), key); err == nil {
+			t.Errorf("PresignGet(%q) didn't fail", key)
+		}
+	}
+}
+
+func TestLocalStoragePath(t *testing.T) {
+	local := &LocalStorage{Root: "/data"}
+	cases := map[string]string{
+		"users/bob/vid":         "/data/users/bob/vid",
+		"/users/bob/vid":        "/data/users/bob/vid",
+		"../../etc/passwd":      "/data/etc/passwd",
+		"users/../../etc/hosts": "/data/etc/hosts",
+	}
+	for key, want := range cases {
+		got, err := local.path(key)
+		if err != nil {
+			t.Errorf("path(%q) failed: %v", key, err)
+			continue
+		}
+		if got != filepath.FromSlash(want) {
+			t.Errorf("path(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLocalStorageServeHTTP(t *testing.T) {
+	local, _ := newLocalStorageServer(t)
+	ctx := context.Background()
+	key := "users/bob/videos/abc/vid"
+	content := "not really a video"
+
+	put, err := local.PresignPut(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := doStorageRequest(t, http.MethodPut, put, strings.NewReader(content))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("put returned %d", res.StatusCode)
+	}
+	sum := md5.Sum([]byte(content))
+	if got, want := res.Header.Get("ETag"), fmt.Sprintf("%q", hex.EncodeToString(sum[:])); got != want {
+		t.Fatalf("etag = %s, want %s", got, want)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(local.Root, filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != content {
+		t.Fatalf("stored %q, want %q", stored, content)
+	}
+
+	get, err := local.PresignGet(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := doStorageRequest(t, http.MethodGet, get, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("get returned %d", res.StatusCode)
+	}
+	if body != content {
+		t.Fatalf("got %q, want %q", body, content)
+	}
+
+	// A put url only allows uploading.
+	res, code := doStorageRequest(t, http.MethodGet, put, nil)
+	if res.StatusCode != http.StatusForbidden || code != string(CODE_FORBIDDEN) {
+		t.Fatalf("get with a put url returned %d %s", res.StatusCode, code)
+	}
+}
+
+func TestLocalStorageServeHTTPRejects(t *testing.T) {
+	local, srv := newLocalStorageServer(t)
+	key := "users/bob/videos/abc/vid"
+	if err := os.MkdirAll(filepath.Join(local.Root, "users/bob/videos/abc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local.Root, filepath.FromSlash(key)), []byte("video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Builds a url for the key by hand, so the signature can be tampered with.
+	signedURL := func(method, key string, expires int64, signature string) string {
+		query := url.Values{}
+		query.Set("expires", strconv.FormatInt(expires, 10))
+		query.Set("signature", signature)
+		return fmt.Sprintf("%s/storage/%s?%s", srv.URL, key, query.Encode())
+	}
+	valid := time.Now().Add(time.Minute).Unix()
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	cases := []struct {
+		name   string
+		method string
+		url    string
+		status int
+	}{
+		{
+			name:   "unsigned",
+			method: http.MethodGet,
+			url:    srv.URL + "/storage/" + key,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "expired",
+			method: http.MethodGet,
+			url:    signedURL(http.MethodGet, key, expired, local.signature(http.MethodGet, key, expired)),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "tampered signature",
+			method: http.MethodGet,
+			url:    signedURL(http.MethodGet, key, valid, strings.Repeat("0", 64)),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "extended expiry",
+			method: http.MethodGet,
+			url:    signedURL(http.MethodGet, key, valid+3600, local.signature(http.MethodGet, key, valid)),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "other key",
+			method: http.MethodGet,
+			url:    signedURL(http.MethodGet, "users/eve/videos/abc/vid", valid, local.signature(http.MethodGet, key, valid)),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unsupported method",
+			method: http.MethodDelete,
+			url:    signedURL(http.MethodDelete, key, valid, local.signature(http.MethodDelete, key, valid)),
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res, _ := doStorageRequest(t, c.method, c.url, nil)
+			if res.StatusCode != c.status {
+				t.Fatalf("returned %d, want %d", res.StatusCode, c.status)
+			}
+		})
+	}
+
+	// None of the rejected requests touched the object.
+	stored, err := os.ReadFile(filepath.Join(local.Root, filepath.FromSlash(key)))
+	if err != nil || string(stored) != "video" {
+		t.Fatalf("object changed: %q %v", stored, err)
+	}
+}
+
+type failingReader struct{ sent bool }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	f.sent = true
+	return copy(p, "half of a vid"), nil
+}
+
+// An upload cut short leaves nothing, not even what was already sent.
+func TestLocalStorageInterruptedPut(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "users/bob/videos/abc/vid"
+	put, err := local.PresignPut(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, put, &failingReader{})
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "key", Value: "/" + key}}))
+	w := httptest.NewRecorder()
+	local.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("put returned %d", w.Code)
+	}
+
+	if _, err := local.Stat(context.Background(), key); err != ErrObjectNotFound {
+		t.Fatalf("stat returned %v, want ErrObjectNotFound", err)
+	}
+	left, err := os.ReadDir(filepath.Join(local.Root, "users/bob/videos/abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("left %s behind", left[0].Name())
+	}
+}
+
+func TestLocalStorageNeedsSecret(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = "local"
+	cfg.Storage.Secret = ""
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "STORAGE_SECRET") {
+		t.Fatalf("got %v, want the missing secret", err)
+	}
+}
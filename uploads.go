@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/help-me-someone/scalable-p2-db/functions/crud"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// Length of the random directory every uploaded video is saved under.
+const videoKeyLength = 100
+
+// The key the raw upload of a video is saved to. The worker picks it up
+// from there.
+func uploadKeyPath(username, videoKey string) string {
+	return fmt.Sprintf("users/%s/videos/%s/vid", username, videoKey)
+}
+
+// Video keys are generated by uniuri, anything else is rejected so the key
+// can't be used to point outside of the user's directory.
+func validVideoKey(key string) bool {
+	if len(key) != videoKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the store as a MultipartStorage, failing the request if the
+// configured backend can't do multipart uploads.
+func (s *Server) multipartStorage(w http.ResponseWriter, r *http.Request) (MultipartStorage, bool) {
+	store, ok := s.Storage.(MultipartStorage)
+	if !ok {
+		Fail(w, r, CODE_NOT_SUPPORTED, "Multipart uploads are not supported.")
+	}
+	return store, ok
+}
+
+// Parses the parameters shared by every multipart endpoint. The upload can
+// only ever target the requesting user's own directory, and only while its
+// session is still open.
+func (s *Server) multipartUploadParams(w http.ResponseWriter, r *http.Request, p httprouter.Params) (*UploadSession, string, bool) {
+	username, ok := requireUsername(w, r)
+	if !ok {
+		return nil, "", false
+	}
+
+	videoKey := p.ByName("key")
+	if !validVideoKey(videoKey) {
+		Fail(w, r, CODE_INVALID_REQUEST, "Invalid video key.")
+		return nil, "", false
+	}
+
+	uploadID := r.URL.Query().Get("upload_id")
+	if len(uploadID) == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "Upload id not specified.")
+		return nil, "", false
+	}
+
+	session, err := s.activeUploadSession(username, videoKey)
+	if err != nil {
+		WriteError(w, r, err)
+		return nil, "", false
+	}
+	if session.UploadID != uploadID || session.Status != UPLOAD_PENDING {
+		WriteError(w, r, errUploadSessionNotFound)
+		return nil, "", false
+	}
+
+	return session, uploadKeyPath(username, videoKey), true
+}
+
+// The error sent when the store failed. Parts which don't add up are the
+// client's fault, the message is used for anything but those and a missing
+// upload.
+func multipartError(err error, message string) error {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		return errUploadSessionNotFound
+	case errors.Is(err, ErrInvalidPart):
+		return NewAPIError(CODE_INVALID_REQUEST, "A part is missing or does not match its etag.")
+	case errors.Is(err, ErrInvalidPartOrder):
+		return NewAPIError(CODE_INVALID_REQUEST, "Parts must be listed in ascending order.")
+	case errors.Is(err, ErrPartTooSmall):
+		return NewAPIError(CODE_INVALID_REQUEST, "Every part but the last must be at least 5 MiB.")
+	}
+	return Internal(err, message)
+}
+
+// Starts a multipart upload. Large videos are uploaded in parts so a
+// dropped connection only costs the part which was in flight.
+func (s *Server) CreateMultipartUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := requireUsername(w, r)
+	if !ok {
+		return
+	}
+
+	store, ok := s.multipartStorage(w, r)
+	if !ok {
+		return
+	}
+
+	randomKey := uniuri.NewLen(videoKeyLength)
+	uploadID, err := store.CreateMultipartUpload(r.Context(), uploadKeyPath(username, randomKey))
+	if err != nil {
+		FailInternal(w, r, err, "Failed to create multipart upload.")
+		return
+	}
+
+	if _, err := s.createUploadSession(username, randomKey, uploadID); err != nil {
+		store.AbortMultipartUpload(r.Context(), uploadKeyPath(username, randomKey), uploadID)
+		WriteError(w, r, err)
+		return
+	}
+
+	WriteJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"key":       randomKey,
+		"upload_id": uploadID,
+	})
+}
+
+// Returns a presigned url the client PUTs a single part to. The ETag header
+// of that PUT's response is needed to complete the upload.
+func (s *Server) GetMultipartUploadPartUrl(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, key, ok := s.multipartUploadParams(w, r, p)
+	if !ok {
+		return
+	}
+	uploadID := session.UploadID
+
+	partNumber, err := strconv.Atoi(p.ByName("part"))
+	if err != nil || partNumber < minPartNumber || partNumber > maxPartNumber {
+		Fail(w, r, CODE_INVALID_REQUEST, fmt.Sprintf("Part number must be between %d and %d.", minPartNumber, maxPartNumber))
+		return
+	}
+
+	store, ok := s.multipartStorage(w, r)
+	if !ok {
+		return
+	}
+
+	url, err := store.PresignUploadPart(r.Context(), key, uploadID, int32(partNumber))
+	if err != nil {
+		WriteError(w, r, multipartError(err, "Failed to presign part."))
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"url":         url,
+		"part_number": partNumber,
+	})
+}
+
+// Lists the parts which already made it, so a client can resume from there.
+func (s *Server) ListMultipartUploadParts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, key, ok := s.multipartUploadParams(w, r, p)
+	if !ok {
+		return
+	}
+	uploadID := session.UploadID
+
+	store, ok := s.multipartStorage(w, r)
+	if !ok {
+		return
+	}
+
+	parts, err := store.ListParts(r.Context(), key, uploadID)
+	if err != nil {
+		WriteError(w, r, multipartError(err, "Failed to list parts."))
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"parts": parts,
+	})
+}
+
+// Assembles the uploaded parts into the video. When the body doesn't list
+// the parts, every uploaded part is used.
+func (s *Server) CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, key, ok := s.multipartUploadParams(w, r, p)
+	if !ok {
+		return
+	}
+	uploadID := session.UploadID
+
+	store, ok := s.multipartStorage(w, r)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Parts []UploadedPart `json:"parts"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			Fail(w, r, CODE_INVALID_REQUEST, "Invalid parts.")
+			return
+		}
+	}
+
+	parts := payload.Parts
+	if len(parts) == 0 {
+		uploaded, err := store.ListParts(r.Context(), key, uploadID)
+		if err != nil {
+			WriteError(w, r, multipartError(err, "Failed to list parts."))
+			return
+		}
+		parts = uploaded
+	}
+	if len(parts) == 0 {
+		Fail(w, r, CODE_INVALID_REQUEST, "No parts were uploaded.")
+		return
+	}
+
+	if err := store.CompleteMultipartUpload(r.Context(), key, uploadID, parts); err != nil {
+		WriteError(w, r, multipartError(err, "Failed to complete upload."))
+		return
+	}
+
+	if err := s.setUploadSessionStatus(session, UPLOAD_COMPLETED); err != nil {
+		FailInternal(w, r, err, "Failed to complete upload.")
+		return
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Upload completed.",
+		"key":     p.ByName("key"),
+	})
+}
+
+// Drops an upload which won't be finished, along with its parts.
+func (s *Server) AbortMultipartUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, key, ok := s.multipartUploadParams(w, r, p)
+	if !ok {
+		return
+	}
+	uploadID := session.UploadID
+
+	store, ok := s.multipartStorage(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.AbortMultipartUpload(r.Context(), key, uploadID); err != nil {
+		WriteError(w, r, multipartError(err, "Failed to abort upload."))
+		return
+	}
+
+	if err := s.setUploadSessionStatus(session, UPLOAD_ABORTED); err != nil {
+		log.Println("Failed to update upload session:", err)
+	}
+
+	WriteJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Upload aborted.",
+	})
+}
+
+var (
+	errUploadSessionNotFound = NewAPIError(CODE_UPLOAD_NOT_FOUND, "Upload not found.")
+	errUploadSessionExpired  = NewAPIError(CODE_UPLOAD_EXPIRED, "Upload expired.")
+	errUploadSessionClosed   = NewAPIError(CODE_UPLOAD_CLOSED, "Upload already saved or aborted.")
+)
+
+// Creates the session tracking an upload the user is about to make.
+func (s *Server) createUploadSession(username, videoKey, uploadID string) (*UploadSession, error) {
+	usr, err := crud.GetUserByName(s.DB, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, NewAPIError(CODE_USER_NOT_FOUND, "User not found.")
+	}
+	if err != nil {
+		return nil, Internal(err, "Failed to get user.")
+	}
+	session := &UploadSession{
+		Key:       videoKey,
+		UserID:    usr.ID,
+		Username:  username,
+		UploadID:  uploadID,
+		Status:    UPLOAD_PENDING,
+		ExpiresAt: time.Now().Add(time.Duration(s.Config.Upload.SessionTTL)),
+	}
+	if err := s.DB.Create(session).Error; err != nil {
+		return nil, Internal(err, "Failed to create upload session.")
+	}
+	return session, nil
+}
+
+// Returns the session of the video if it belongs to username and can still
+// be used.
+func (s *Server) activeUploadSession(username, videoKey string) (*UploadSession, error) {
+	session := &UploadSession{}
+	err := s.DB.Where(&UploadSession{Key: videoKey}).First(session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, Internal(err, "Failed to get upload session.")
+	}
+
+	// Someone else's upload is treated as if it didn't exist.
+	if session.Username != username {
+		return nil, errUploadSessionNotFound
+	}
+	if session.Status != UPLOAD_PENDING && session.Status != UPLOAD_COMPLETED {
+		return nil, errUploadSessionClosed
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, errUploadSessionExpired
+	}
+	return session, nil
+}
+
+func (s *Server) setUploadSessionStatus(session *UploadSession, status string) error {
+	return s.DB.Model(session).Update("status", status).Error
+}
+
+// Makes sure the uploaded video is there and is something we are willing
+// to transcode, before any work gets queued for it.
+func (s *Server) checkUploadedVideo(ctx context.Context, session *UploadSession) error {
+	if len(session.UploadID) > 0 && session.Status != UPLOAD_COMPLETED {
+		return NewAPIError(CODE_UPLOAD_INCOMPLETE, "Upload not completed.")
+	}
+
+	info, err := s.Storage.Stat(ctx, uploadKeyPath(session.Username, session.Key))
+	if errors.Is(err, ErrObjectNotFound) {
+		return NewAPIError(CODE_VIDEO_NOT_UPLOADED, "Video was not uploaded.")
+	}
+	if err != nil {
+		return Internal(err, "Failed to check uploaded video.")
+	}
+
+	if info.Size == 0 {
+		return NewAPIError(CODE_VIDEO_NOT_UPLOADED, "Uploaded video is empty.")
+	}
+	if info.Size > s.Config.Upload.MaxSize {
+		return NewAPIError(CODE_VIDEO_TOO_LARGE, fmt.Sprintf("Video is larger than %d bytes.", s.Config.Upload.MaxSize))
+	}
+
+	// The content type of the object is whatever the client sent, or
+	// nothing at all for multipart uploads. The container says what it is.
+	object, err := s.Storage.GetObject(ctx, uploadKeyPath(session.Username, session.Key))
+	if err != nil {
+		return Internal(err, "Failed to check uploaded video.")
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(object, head)
+	object.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return Internal(err, "Failed to check uploaded video.")
+	}
+
+	contentType := sniffVideoType(head[:n])
+	for _, allowed := range s.Config.Upload.ContentTypes {
+		if strings.EqualFold(contentType, strings.TrimSpace(allowed)) {
+			return nil
+		}
+	}
+	return NewAPIError(CODE_UNSUPPORTED_VIDEO, fmt.Sprintf("Unsupported video type %q.", contentType))
+}
+
+// Tells the type of a video from its first bytes. http.DetectContentType
+// only knows some mp4 and webm files, QuickTime and Matroska are
+// application/octet-stream to it.
+func sniffVideoType(head []byte) string {
+	// ISO base media files (mp4, mov) start with a box, ftyp names the brand.
+	if len(head) >= 12 {
+		switch string(head[4:8]) {
+		case "ftyp":
+			if string(head[8:12]) == "qt  " {
+				return "video/quicktime"
+			}
+			return "video/mp4"
+		case "moov", "mdat", "wide", "free", "skip":
+			// Old QuickTime files have no ftyp.
+			return "video/quicktime"
+		}
+	}
+	// Matroska and WebM share the EBML header, the doctype tells them apart.
+	if bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")) {
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return contentType
+}
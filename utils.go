@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -13,13 +14,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/help-me-someone/scalable-p2-backend/internal/m3u8"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-// gorm.DB objects are meant to be reused.
-var GORM_CONNECTION_SINGLETON *gorm.DB
-
 // Timer function from https://stackoverflow.com/questions/45766572/is-there-an-efficient-way-to-calculate-execution-time-in-golang
 func timer(name string) func() {
 	start := time.Now()
@@ -28,22 +27,19 @@ func timer(name string) func() {
 	}
 }
 
-func GeneratePresignedUrl(key string, client *s3.Client) (string, error) {
-	presignClient := s3.NewPresignClient(client)
-	url, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String("toktik-videos"),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return "", err
-	}
-	return url.URL, nil
+func GeneratePresignedUrl(key string, store Storage) (string, error) {
+	return store.PresignGet(context.TODO(), key)
 }
 
-func GetS3Client(region string) (*s3.Client, error) {
+// Creates a client for the S3 compatible endpoint. When endpoint is empty
+// the DigitalOcean Spaces endpoint of the region is used.
+func GetS3Client(region, endpoint string) (*s3.Client, error) {
+	if len(endpoint) == 0 {
+		endpoint = "https://" + region + ".digitaloceanspaces.com"
+	}
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
-			URL: "https://" + region + ".digitaloceanspaces.com",
+			URL: endpoint,
 		}, nil
 	})
 
@@ -64,89 +60,180 @@ func GetS3Client(region string) (*s3.Client, error) {
 	return s3.NewFromConfig(cfg), nil
 }
 
-func GenerateVideoThumbnailUrl(client *s3.Client, username, videoKey string) (string, error) {
+func GenerateVideoThumbnailUrl(store Storage, username, videoKey string) (string, error) {
 	thumbnailKey := fmt.Sprintf("users/%s/videos/%s/thumbnail", username, videoKey)
-	return GeneratePresignedUrl(thumbnailKey, client)
+	return GeneratePresignedUrl(thumbnailKey, store)
 }
 
+// The root playlist the worker writes for every video. It is either a media
+// playlist, or a master playlist listing one media playlist per rendition.
+const rootPlaylist = "vid.m3u8"
+
+// A playlist pointing at something outside of its video's directory, which
+// would otherwise get urls to other users' objects.
+var ErrPlaylistOutsideVideo = errors.New("playlist uri points outside of the video")
+
+// How many urls are presigned at the same time for a single playlist.
+const presignWorkers = 16
+
 // Creates a HLS file with presigned urls.
 // Input:
 // - username
 // - videoKey
-func GenerateHSLFile(client *s3.Client, username, videoKey string) (bytes.Buffer, error) {
+// - playlistPath, relative to the video's directory, e.g. "720p/vid.m3u8"
+// - variantUrl, returns the url a variant playlist is served from
+//
+// Segments, keys and init sections of a media playlist are replaced by
+// presigned urls. The variants of a master playlist are pointed at
+// variantUrl instead, as their segments need to be presigned as well.
+func GenerateHSLFile(store Storage, username, videoKey, playlistPath string, variantUrl func(string) string) (bytes.Buffer, error) {
 	defer timer("GenerateHSLFile")()
 	root := fmt.Sprintf("users/%s/videos/%s", username, videoKey)
+	dir := path.Dir(playlistPath)
 
-	// Get the HLS root file.
-	key := aws.String(fmt.Sprintf("%s/vid.m3u8", root))
-	object, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String("toktik-videos"),
-		Key:    key,
-	})
+	// Get the HLS file.
+	key := fmt.Sprintf("%s/%s", root, playlistPath)
+	object, err := store.GetObject(context.TODO(), key)
 	if err != nil {
 		log.Println("Failed to get object:", err)
 		return bytes.Buffer{}, err
 	}
+	defer object.Close()
 
-	scanner := bufio.NewScanner(object.Body)
-	urlMappings := sync.Map{}
+	playlist, err := m3u8.Parse(object)
+	if err != nil {
+		log.Println("Failed to parse playlist:", err)
+		return bytes.Buffer{}, err
+	}
 
-	// Create a wait group
-	var wg sync.WaitGroup
-	count := 0
-	for scanner.Scan() {
-		scanned := scanner.Text()
-		wg.Add(1)
-		go func(scanned string, line int) {
-			defer wg.Done()
-			if strings.HasPrefix(scanned, "vid") {
-				fileKey := fmt.Sprintf("%s/%s", root, scanned)
-				url, _ := GeneratePresignedUrl(fileKey, client)
-				urlMappings.Store(line, fmt.Sprintf("%s\n", url))
-			} else {
-				urlMappings.Store(line, fmt.Sprintf("%s\n", scanned))
-			}
-		}(scanned, count)
-		count += 1
+	// Urls are relative to the playlist, absolute ones are left untouched.
+	// Relative ones have to stay inside of the video.
+	resolve := func(uri string) (string, bool, error) {
+		if len(uri) == 0 || strings.Contains(uri, "://") {
+			return "", false, nil
+		}
+		rel := path.Join(dir, uri)
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", false, ErrPlaylistOutsideVideo
+		}
+		return rel, true, nil
 	}
-	wg.Wait()
 
-	log.Println("Waiting...")
+	if playlist.IsMaster() {
+		uris := make([]*string, 0, len(playlist.Variants)+len(playlist.IFrameVariants))
+		for _, variant := range playlist.Variants {
+			uris = append(uris, &variant.URI)
+		}
+		for _, variant := range playlist.IFrameVariants {
+			uris = append(uris, &variant.URI)
+		}
+		for _, uri := range uris {
+			rel, ok, err := resolve(*uri)
+			if err != nil {
+				log.Printf("Refused %s of %s: %v", *uri, key, err)
+				return bytes.Buffer{}, err
+			}
+			if ok {
+				*uri = variantUrl(rel)
+			}
+		}
+		for _, rendition := range playlist.Renditions {
+			uri, _ := rendition.URI()
+			rel, ok, err := resolve(uri)
+			if err != nil {
+				log.Printf("Refused %s of %s: %v", uri, key, err)
+				return bytes.Buffer{}, err
+			}
+			if ok {
+				rendition.SetURI(variantUrl(rel))
+			}
+		}
+	} else {
+		// Every uri of the playlist which points into the bucket.
+		uris := make([]*string, 0, len(playlist.Segments))
+		for _, segment := range playlist.Segments {
+			uris = append(uris, &segment.URI)
+			if segment.Key != nil {
+				uris = append(uris, &segment.Key.URI)
+			}
+			if segment.Map != nil {
+				uris = append(uris, &segment.Map.URI)
+			}
+		}
+		if err := presignAll(store, root, uris, resolve); err != nil {
+			log.Println("Failed to presign segment:", err)
+			return bytes.Buffer{}, err
+		}
+	}
 
 	var answerBuf bytes.Buffer
+	playlist.WriteTo(&answerBuf)
+	return answerBuf, nil
+}
 
-	for v := 0; v < count; v++ {
-		line, _ := urlMappings.Load(v)
-		answerBuf.WriteString(line.(string))
-	}
+// Replaces every uri by its presigned url, using at most presignWorkers
+// goroutines.
+func presignAll(store Storage, root string, uris []*string, resolve func(string) (string, bool, error)) error {
+	jobs := make(chan *string)
+	errs := make(chan error, presignWorkers)
 
-	if err := scanner.Err(); err != nil {
-		log.Println(err)
-		return bytes.Buffer{}, err
+	var wg sync.WaitGroup
+	for i := 0; i < presignWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var failed error
+			for uri := range jobs {
+				if failed != nil {
+					continue
+				}
+				rel, ok, err := resolve(*uri)
+				if err != nil {
+					failed = err
+					continue
+				}
+				if !ok {
+					continue
+				}
+				url, err := GeneratePresignedUrl(fmt.Sprintf("%s/%s", root, rel), store)
+				if err != nil {
+					failed = err
+					continue
+				}
+				*uri = url
+			}
+			errs <- failed
+		}()
 	}
 
-	return answerBuf, nil
-}
+	for _, uri := range uris {
+		jobs <- uri
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
 
-// Create and return a new database connection. Ideally we
-// would check the logins etc, but we don't live in an ideal
-// world here. I got deadlines to meet. Well technically if
-// the credentials are wrong the connection could never be
-// made, so I guess it's fine...?
-func GetDatabaseConnection(username, password, server string) (*gorm.DB, error) {
-	if GORM_CONNECTION_SINGLETON == nil {
-		dsn := fmt.Sprintf(
-			"%s:%s@tcp(%s)/toktik-db?charset=utf8mb4&parseTime=True&loc=Local",
-			username,
-			password,
-			server,
-		)
-		connection, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	for err := range errs {
 		if err != nil {
-			return nil, err
-		} else {
-			GORM_CONNECTION_SINGLETON = connection
+			return err
 		}
 	}
-	return GORM_CONNECTION_SINGLETON, nil
+	return nil
+}
+
+// Checks that a variant path requested by a player points at a playlist
+// inside of the video's directory.
+func ValidPlaylistPath(playlistPath string) (string, bool) {
+	cleaned := path.Clean("/" + playlistPath)[1:]
+	if len(cleaned) == 0 || !strings.HasSuffix(cleaned, ".m3u8") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// Create and return a new database connection. gorm.DB objects are
+// meant to be reused and are safe for concurrent use, so this should
+// only be called once when the server starts.
+func OpenDatabase(cfg DatabaseConfig) (*gorm.DB, error) {
+	return gorm.Open(mysql.Open(cfg.DSN()), &gorm.Config{})
 }
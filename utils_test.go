@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/help-me-someone/scalable-p2-backend/internal/m3u8"
+)
+
+// Copies the m3u8 fixture into bob's video "abc", at playlistPath.
+func storeFixturePlaylist(t *testing.T, store *LocalStorage, fixture, playlistPath string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("internal", "m3u8", "testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(store.Root, "users", "bob", "videos", "abc", filepath.FromSlash(playlistPath))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Checks that rawURL is a valid presigned download of key.
+func checkPresigned(t *testing.T, store *LocalStorage, rawURL, key string) {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != store.BaseURL+"/"+key {
+		t.Errorf("%s points at %s, want %s", rawURL, got, store.BaseURL+"/"+key)
+		return
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Errorf("%s: bad expires", rawURL)
+		return
+	}
+	if u.Query().Get("signature") != store.signature("GET", key, expires) {
+		t.Errorf("%s: bad signature", rawURL)
+	}
+}
+
+func TestGenerateHSLFileMedia(t *testing.T) {
+	store, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := storeFixturePlaylist(t, store, "media.m3u8", "720p/index.m3u8")
+
+	buf, err := GenerateHSLFile(store, "bob", "abc", "720p/index.m3u8", func(string) string {
+		t.Fatal("media playlists have no variants")
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := m3u8.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := m3u8.Parse(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rewritten.Segments) != len(fixture.Segments) {
+		t.Fatalf("got %d segments, want %d", len(rewritten.Segments), len(fixture.Segments))
+	}
+
+	root := "users/bob/videos/abc/"
+	segments := rewritten.Segments
+	checkPresigned(t, store, segments[0].URI, root+"720p/vid0.m4s")
+	checkPresigned(t, store, segments[0].Key.URI, root+"720p/keys/key0.bin")
+	checkPresigned(t, store, segments[0].Map.URI, root+"720p/init.mp4")
+	checkPresigned(t, store, segments[1].URI, root+"720p/vid1.m4s")
+	checkPresigned(t, store, segments[3].URI, root+"720p/vid2.m4s")
+
+	// Absolute urls aren't ours to sign, and a key without a uri stays so.
+	if segments[2].URI != "https://cdn.example.com/ads/ad0.m4s" {
+		t.Errorf("absolute segment rewritten to %s", segments[2].URI)
+	}
+	if segments[2].Map.URI != "https://cdn.example.com/ads/init.mp4" {
+		t.Errorf("absolute map rewritten to %s", segments[2].Map.URI)
+	}
+	if len(segments[3].Key.URI) > 0 {
+		t.Errorf("key without uri got %s", segments[3].Key.URI)
+	}
+
+	// Apart from the uris, the playlist is written back as it was.
+	for i, segment := range rewritten.Segments {
+		segment.URI = fixture.Segments[i].URI
+		if segment.Key != nil {
+			segment.Key.URI = fixture.Segments[i].Key.URI
+		}
+		if segment.Map != nil {
+			segment.Map.URI = fixture.Segments[i].Map.URI
+		}
+	}
+	if rewritten.String() != string(original) {
+		t.Fatalf("playlist changed:\n%s\nwant:\n%s", rewritten, original)
+	}
+}
+
+func TestGenerateHSLFileMaster(t *testing.T) {
+	store, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := storeFixturePlaylist(t, store, "master.m3u8", rootPlaylist)
+
+	buf, err := GenerateHSLFile(store, "bob", "abc", rootPlaylist, func(rel string) string {
+		return "http://localhost:7000/video/bob/abc/playlist/" + rel
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := m3u8.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variant := "http://localhost:7000/video/bob/abc/playlist/"
+	if got := rewritten.Variants[0].URI; got != variant+"720p/index.m3u8" {
+		t.Errorf("variant uri = %s", got)
+	}
+	if got := rewritten.Variants[1].URI; got != "https://cdn.example.com/360p/index.m3u8" {
+		t.Errorf("absolute variant rewritten to %s", got)
+	}
+	if got := rewritten.IFrameVariants[0].URI; got != variant+"720p/iframes.m3u8" {
+		t.Errorf("i-frame variant uri = %s", got)
+	}
+	if got, _ := rewritten.Renditions[0].URI(); got != variant+"audio/en.m3u8" {
+		t.Errorf("rendition uri = %s", got)
+	}
+	if _, ok := rewritten.Renditions[1].URI(); ok {
+		t.Error("a uri was added to the closed captions")
+	}
+
+	// Unknown tags and attributes survive the rewrite.
+	want := strings.NewReplacer(
+		`URI="audio/en.m3u8"`, `URI="`+variant+`audio/en.m3u8"`,
+		"\n720p/index.m3u8\n", "\n"+variant+"720p/index.m3u8\n",
+		`URI="720p/iframes.m3u8"`, `URI="`+variant+`720p/iframes.m3u8"`,
+	).Replace(string(original))
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestGenerateHSLFileMissing(t *testing.T) {
+	store, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateHSLFile(store, "bob", "abc", rootPlaylist, nil); err != ErrObjectNotFound {
+		t.Fatalf("got %v, want ErrObjectNotFound", err)
+	}
+}
+
+// Playlists can't get urls to anything outside of their video.
+func TestGenerateHSLFileOutsideVideo(t *testing.T) {
+	cases := map[string]string{
+		"segment": "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\n../../../alice/videos/xyz/720p/vid0.m4s\n#EXT-X-ENDLIST\n",
+		"key":     "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-KEY:METHOD=AES-128,URI=\"../../../../secret.bin\"\n#EXTINF:4,\nvid0.m4s\n#EXT-X-ENDLIST\n",
+		"variant": "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\n../../xyz/720p/index.m3u8\n",
+	}
+	for name, playlist := range cases {
+		store, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(store.Root, "users", "bob", "videos", "abc", "720p", "index.m3u8")
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = GenerateHSLFile(store, "bob", "abc", "720p/index.m3u8", func(rel string) string { return rel })
+		if err != ErrPlaylistOutsideVideo {
+			t.Errorf("%s: got %v, want ErrPlaylistOutsideVideo", name, err)
+		}
+	}
+
+	// Going up is fine as long as it stays in the video.
+	store, err := NewLocalStorage(t.TempDir(), "http://localhost:7000/storage", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(store.Root, "users", "bob", "videos", "abc", "720p", "index.m3u8")
+	os.MkdirAll(filepath.Dir(p), 0o755)
+	os.WriteFile(p, []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\n../shared/vid0.m4s\n#EXT-X-ENDLIST\n"), 0o644)
+	buf, err := GenerateHSLFile(store, "bob", "abc", "720p/index.m3u8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "/users/bob/videos/abc/shared/vid0.m4s?") {
+		t.Fatalf("got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/help-me-someone/scalable-p2-db/models/user"
+	"github.com/help-me-someone/scalable-p2-db/models/video"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Redis keys of the view counter. The views not flushed yet are kept in a
+// hash of video id to count, which is moved aside while it is flushed.
+const (
+	pendingViewsKey   = "views:pending"
+	flushingViewsKey  = "views:flushing"
+	viewsFlushLockKey = "views:flush:lock"
+)
+
+// The field of the flushing views holding the id of the flush.
+const viewsFlushIDField = "flush"
+
+// How long the flushed batches are remembered. A flush is long done or
+// given up on by then.
+const viewFlushRetention = 24 * time.Hour
+
+// The marker of a viewer who watched the video recently.
+func viewerKey(videoID uint, viewer string) string {
+	return fmt.Sprintf("views:seen:%d:%s", videoID, viewer)
+}
+
+// Moves the pending views aside to be flushed, giving them a flush id.
+// Views left there by a flush which didn't finish are flushed again first,
+// under the same id. Returns 0 when there is nothing to flush.
+var takePendingViews = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+	redis.call("RENAME", KEYS[1], KEYS[2])
+end
+redis.call("HSETNX", KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// Who is watching, the user when they are logged in, otherwise where the
+// request came from.
+func (s *Server) requestViewer(r *http.Request, usr *user.User) string {
+	if usr != nil && usr.ID != 0 {
+		return fmt.Sprintf("user:%d", usr.ID)
+	}
+	return "ip:" + s.clientIP(r)
+}
+
+// The address of the client. Forwarded addresses are only followed through
+// the trusted proxies, anyone else could put whatever they want in there.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trustedProxy(host) {
+		return host
+	}
+
+	// Each proxy appends who it got the request from, the client is the
+	// last address not added by one of ours.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewCounter counts the views in redis and adds them to the videos in
+// batches, so a popular video doesn't have every viewer waiting on its row.
+// A viewer is only counted once per Window.
+type ViewCounter struct {
+	DB    *gorm.DB
+	Redis *redis.Client
+
+	Window time.Duration
+
+	// How often the views are added to the videos.
+	Interval time.Duration
+
+	// Videos updated per transaction.
+	BatchSize int
+}
+
+func NewViewCounter(db *gorm.DB, client *redis.Client, cfg ViewsConfig) *ViewCounter {
+	return &ViewCounter{
+		DB:        db,
+		Redis:     client,
+		Window:    time.Duration(cfg.Window),
+		Interval:  time.Duration(cfg.FlushInterval),
+		BatchSize: cfg.BatchSize,
+	}
+}
+
+// Record counts the view, unless the viewer already watched the video
+// within the window. Returns whether it was counted.
+func (c *ViewCounter) Record(ctx context.Context, videoID uint, viewer string) (bool, error) {
+	fresh, err := c.Redis.SetNX(ctx, viewerKey(videoID, viewer), 1, c.Window).Result()
+	if err != nil || !fresh {
+		return false, err
+	}
+	return true, c.Redis.HIncrBy(ctx, pendingViewsKey, strconv.FormatUint(uint64(videoID), 10), 1).Err()
+}
+
+// Run flushes the views until the context is cancelled, and once more when
+// it is.
+func (c *ViewCounter) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Flush(context.Background()); err != nil {
+				log.Println("Failed to flush views:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Println("Failed to flush views:", err)
+			}
+		}
+	}
+}
+
+// Flush adds the pending views to the videos. Only one replica flushes at a
+// time, the others skip their turn. Views counted while it runs wait for
+// the next one.
+func (c *ViewCounter) Flush(ctx context.Context) error {
+	release, locked, err := acquireLock(ctx, c.Redis, viewsFlushLockKey, 2*c.Interval+time.Minute)
+	if err != nil || !locked {
+		return err
+	}
+	defer release()
+
+	keys := []string{pendingViewsKey, flushingViewsKey}
+	taken, err := takePendingViews.Run(ctx, c.Redis, keys, viewsFlushIDField, uniuri.NewLen(16)).Int()
+	if err != nil || taken == 0 {
+		return err
+	}
+	pending, err := c.Redis.HGetAll(ctx, flushingViewsKey).Result()
+	if err != nil {
+		return err
+	}
+	flushID := pending[viewsFlushIDField]
+
+	// Always in the same order, so the rows are locked in the same order.
+	ids := make([]uint, 0, len(pending))
+	counts := make(map[uint]int64, len(pending))
+	for field, value := range pending {
+		id, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count <= 0 {
+			continue
+		}
+		ids = append(ids, uint(id))
+		counts[uint(id)] = count
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for start := 0; start < len(ids); start += c.BatchSize {
+		end := start + c.BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		if err := c.flushBatch(flushID, batch, counts); err != nil {
+			return err
+		}
+
+		// Should this fail, the batch is flushed again and skipped.
+		fields := make([]string, 0, len(batch))
+		for _, id := range batch {
+			fields = append(fields, strconv.FormatUint(uint64(id), 10))
+		}
+		if err := c.Redis.HDel(ctx, flushingViewsKey, fields...).Err(); err != nil {
+			return err
+		}
+	}
+	if err := c.Redis.Del(ctx, flushingViewsKey).Err(); err != nil {
+		return err
+	}
+
+	return c.DB.Where("created_at < ?", time.Now().Add(-viewFlushRetention)).Delete(&ViewFlush{}).Error
+}
+
+// Adds the views of a batch to the videos, unless the batch was already
+// added by an earlier attempt at the same flush. The remaining batches of a
+// flush start where they did the first time, so the first video of the
+// batch tells them apart.
+func (c *ViewCounter) flushBatch(flushID string, ids []uint, counts map[uint]int64) error {
+	now := time.Now()
+	return c.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&ViewFlush{Key: fmt.Sprintf("%s:%d", flushID, ids[0])})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		for _, id := range ids {
+			err := tx.Model(&video.Video{}).
+				Where("id = ?", id).
+				UpdateColumn("views", gorm.Expr("views + ?", counts[id])).Error
+			if err != nil {
+				return err
+			}
+			err = recordDailyStats(tx, &VideoDailyStats{VideoID: id, Day: now, Views: counts[id]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
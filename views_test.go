@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/help-me-someone/scalable-p2-db/models/user"
+	"gorm.io/gorm"
+)
+
+func TestRequestViewer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	proxies, err := cfg.TrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: cfg, trustedProxies: proxies}
+
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		usr       *user.User
+		want      string
+	}{
+		{"direct", "203.0.113.5:4000", nil, nil, "ip:203.0.113.5"},
+		{"forged forwarded", "203.0.113.5:4000", []string{"1.2.3.4"}, nil, "ip:203.0.113.5"},
+		{"through a proxy", "10.0.0.2:4000", []string{"198.51.100.7"}, nil, "ip:198.51.100.7"},
+		{"through two proxies", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.7, 192.168.1.1"}, nil, "ip:198.51.100.7"},
+		{"spread over headers", "10.0.0.2:4000", []string{"1.2.3.4", "198.51.100.7"}, nil, "ip:198.51.100.7"},
+		{"proxy without header", "10.0.0.2:4000", nil, nil, "ip:10.0.0.2"},
+		{"garbage forwarded", "10.0.0.2:4000", []string{"nonsense"}, nil, "ip:10.0.0.2"},
+		{"logged in", "203.0.113.5:4000", nil, &user.User{Model: gorm.Model{ID: 3}, Username: "bob"}, "user:3"},
+		{"unknown user", "203.0.113.5:4000", nil, &user.User{}, "ip:203.0.113.5"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/watch/bob/abc/info", nil)
+		r.RemoteAddr = c.remote
+		// Whatever the header claims, only the looked up user counts.
+		r.Header.Set("X-Username", "mallory")
+		for _, value := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := s.requestViewer(r, c.usr); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTrustedProxiesValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "proxy.local"}
+	if _, err := cfg.TrustedProxies(); err == nil {
+		t.Fatal("a hostname was accepted as a trusted proxy")
+	}
+}
+
+// A batch flushed again after its views were added is skipped.
+func TestViewsFlushBatchTwice(t *testing.T) {
+	db, mock := newMockDB(t)
+	c := &ViewCounter{DB: db}
+	counts := map[uint]int64{3: 2, 5: 1}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `view_flushes`")).
+		WithArgs("abc:3", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `videos` SET `views`=views + ?")).WithArgs(2, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `videos` SET `views`=views + ?")).WithArgs(1, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `video_daily_stats`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := c.flushBatch("abc", []uint{3, 5}, counts); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `view_flushes`")).
+		WithArgs("abc:3", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	if err := c.flushBatch("abc", []uint{3, 5}, counts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}